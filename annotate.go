@@ -0,0 +1,195 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"yangsi/db"
+	"yangsi/entity"
+	"yangsi/log"
+)
+
+const defaultEditor = "vi"
+
+var tagCommands = map[string]func(args []string) error{
+	"add":  tagAdd,
+	"rm":   tagRemove,
+	"list": tagList,
+}
+
+func tagCommand(args []string) error {
+	if len(args) == 0 || tagCommands[args[0]] == nil {
+		return log.NewError("unknown tag command: %v, want add, rm or list", args)
+	}
+	return tagCommands[args[0]](args[1:])
+}
+
+func parseID(s string) (int64, error) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, log.NewError("invalid id: %s", s)
+	}
+	return id, nil
+}
+
+// inTx runs fn in a transaction, committed when fn succeeds.
+func inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return log.NewError("begin failed: %s", err.Error())
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func tagAdd(args []string) error {
+	if len(args) < 2 {
+		return log.NewError("usage: tag add <id> <tag>...")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	return inTx(func(tx *sql.Tx) error {
+		return db.AddTags(tx, id, args[1:]...)
+	})
+}
+
+func tagRemove(args []string) error {
+	if len(args) < 2 {
+		return log.NewError("usage: tag rm <id> <tag>...")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	return inTx(func(tx *sql.Tx) error {
+		return db.RemoveTags(tx, id, args[1:]...)
+	})
+}
+
+// tagList prints the tags of a row, or every tag with its count.
+func tagList(args []string) error {
+	if len(args) > 1 {
+		return log.NewError("usage: tag list [id]")
+	}
+	if len(args) == 1 {
+		id, err := parseID(args[0])
+		if err != nil {
+			return err
+		}
+		tags, err := db.Tags(id)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			fmt.Println(tag)
+		}
+		return nil
+	}
+	counts, err := db.TagCounts()
+	if err != nil {
+		return err
+	}
+	for _, tc := range counts {
+		fmt.Printf("%s\t%d\n", tc.Name, tc.Count)
+	}
+	return nil
+}
+
+// note prints the note of a row, or replaces it with the rest of the
+// arguments; an empty one clears it.
+func note(args []string) error {
+	if len(args) == 0 {
+		return log.NewError("usage: note <id> [text]")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	r, err := db.Get(id)
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		if r.Note != "" {
+			fmt.Println(r.Note)
+		}
+		return nil
+	}
+	r.Note = strings.TrimSpace(strings.Join(args[1:], " "))
+	return inTx(func(tx *sql.Tx) error {
+		return db.Update(tx, r)
+	})
+}
+
+// edit opens $EDITOR on the text of a row, corrected if it was, and keeps
+// what is saved as the corrected text. Saving the recognized text as it is
+// drops the correction.
+func edit(args []string) error {
+	if len(args) != 1 {
+		return log.NewError("usage: edit <id>")
+	}
+	id, err := parseID(args[0])
+	if err != nil {
+		return err
+	}
+	r, err := db.Get(id)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile("", fmt.Sprintf("yangsi-%d-*.txt", id))
+	if err != nil {
+		return log.NewError("create temp file failed: %s", err.Error())
+	}
+	defer os.Remove(file.Name())
+	before := r.Content()
+	_, err = file.WriteString(before + "\n")
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		return log.NewError("write temp file failed: %s", err.Error())
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = defaultEditor
+	}
+	// $EDITOR may carry flags, e.g. "code --wait"
+	fields := strings.Fields(editor)
+	cmd := exec.Command(fields[0], append(fields[1:], file.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return log.NewError("editor failed: %s, %s", editor, err.Error())
+	}
+	data, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return log.NewError("read temp file failed: %s", err.Error())
+	}
+	after := strings.TrimRight(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	if after == before {
+		log.InfoLog("text of %d unchanged", id)
+		return nil
+	}
+	r.CorrectedText = after
+	if after == r.Text {
+		r.CorrectedText = ""
+	}
+	return inTx(func(tx *sql.Tx) error {
+		err := db.Update(tx, r)
+		if err != nil {
+			return err
+		}
+		return db.SetEntities(tx, r.ID, entity.Extract(r.Content()))
+	})
+}
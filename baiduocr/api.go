@@ -5,11 +5,14 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"image"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"sync/atomic"
+	"time"
 	"yangsi/log"
 )
 
@@ -60,9 +63,40 @@ func (e ErrShouldExit) Error() string {
 
 var shouldExit = "token err or no free ocr, should exit"
 
+// statusError is an HTTP status other than 200.
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("get failed: %d", int(e))
+}
+
+/*
+4	Open api request limit reached	集群超限额
+17	Open api daily request limit reached	每天请求量超限额
+18	Open api qps request limit reached	QPS超限额
+19	Open api total request limit reached	请求总量超限额
+282000	internal error	服务器内部错误
+*/
+var transientCodes = map[int]bool{4: true, 17: true, 18: true, 19: true, 282000: true}
+
+// Transient tells whether err is of the service rather than of the image, so
+// that the same image may be recognized later.
+func Transient(err error) bool {
+	switch e := err.(type) {
+	case ErrShouldExit, tokenError, net.Error:
+		return true
+	case statusError:
+		return e == http.StatusTooManyRequests || e >= 500
+	case apiErrType:
+		return transientCodes[e.ErrorCode]
+	}
+	return false
+}
+
 func readResponse(resp *http.Response, out apiError) error {
 	if resp.StatusCode != http.StatusOK {
-		return log.NewWarn("get failed: %d", resp.StatusCode)
+		resp.Body.Close()
+		return statusError(resp.StatusCode)
 	}
 	respData, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
@@ -135,10 +169,61 @@ type orcResult struct {
 	LogID       int64 `json:"log_id"`
 	WordsResult []struct {
 		Words string `json:"words"`
+		// from the general endpoint, with recognize_granularity=small
+		Location location `json:"location"`
+		Chars    []struct {
+			Char     string   `json:"char"`
+			Location location `json:"location"`
+		} `json:"chars"`
+		// with probability=true
+		Probability struct {
+			Average float64 `json:"average"`
+			Min     float64 `json:"min"`
+		} `json:"probability"`
 	} `json:"words_result"`
 	WordsResultNums int `json:"words_result_nums"`
 }
 
+type location struct {
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+func (l location) rect() image.Rectangle {
+	return image.Rect(l.Left, l.Top, l.Left+l.Width, l.Top+l.Height)
+}
+
+// lines is where the lines and their characters are, nil without locations.
+func (o *orcResult) lines() []Line {
+	var lines []Line
+	for i := range o.WordsResult {
+		w := &o.WordsResult[i]
+		if w.Location.Width == 0 {
+			return nil
+		}
+		line := Line{Text: strings.TrimSpace(w.Words), Box: w.Location.rect()}
+		for _, c := range w.Chars {
+			line.Chars = append(line.Chars, Char{c.Char, c.Location.rect()})
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// confidence is the mean of the average probabilities of the lines.
+func (o *orcResult) confidence() float64 {
+	if len(o.WordsResult) == 0 {
+		return 0
+	}
+	var sum float64
+	for i := range o.WordsResult {
+		sum += o.WordsResult[i].Probability.Average
+	}
+	return sum / float64(len(o.WordsResult))
+}
+
 func (o *orcResult) String() string {
 	var buf bytes.Buffer
 	var err error
@@ -164,26 +249,84 @@ func (o *orcResult) String() string {
 	return buf.String()
 }
 
-func OCR(imgData []byte) (string, error) {
+// limiter paces every OCR request of the process, 5 次 / s by default.
+var limiter *time.Ticker
+
+const (
+	Engine   = "baidu"
+	Endpoint = "https://aip.baidubce.com/rest/2.0/ocr/v1/general_basic"
+	// the same with where each line and character is, at a higher price
+	LocateEndpoint = "https://aip.baidubce.com/rest/2.0/ocr/v1/general"
+)
+
+// Line is a line of text and its box in pixels of the image sent, as are the
+// boxes of its characters.
+type Line struct {
+	Text  string
+	Box   image.Rectangle
+	Chars []Char
+}
+
+type Char struct {
+	Char string
+	Box  image.Rectangle
+}
+
+// Result is the text recognized in an image. Direction is the rotation
+// detected by the API: -1 unknown, 0 upright, 1 90° counterclockwise, 2 180°,
+// 3 90° clockwise. Confidence is the mean probability of the lines, 0 to 1.
+// Duration is the time of the request, not counting the wait for the rate
+// limiter. Lines are only there from Locate.
+type Result struct {
+	Text       string
+	Direction  int
+	Confidence float64
+	Duration   time.Duration
+	Endpoint   string
+	Lines      []Line
+}
+
+func OCR(imgData []byte) (*Result, error) {
+	return recognize(Endpoint, imgData, nil)
+}
+
+// Locate recognizes the text like OCR, along with where it is.
+func Locate(imgData []byte) (*Result, error) {
+	return recognize(LocateEndpoint, imgData, url.Values{"recognize_granularity": {"small"}})
+}
+
+func recognize(endpoint string, imgData []byte, extra url.Values) (*Result, error) {
 	// encode
 	enc, err := encodeImg(imgData)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	reqParams := url.Values{}
 	reqParams.Set("language_type", "CHN_ENG")
 	reqParams.Set("detect_direction", "true")
+	reqParams.Set("probability", "true")
 	reqParams.Set("image", string(enc))
+	for k, v := range extra {
+		reqParams[k] = v
+	}
 	var respData orcResult
-	const baseUrl = "https://aip.baidubce.com/rest/2.0/ocr/v1/general_basic"
-	err = post(baseUrl, []byte(reqParams.Encode()), &respData)
+	<-limiter.C
+	start := time.Now()
+	err = post(endpoint, []byte(reqParams.Encode()), &respData)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	// log.RealtimeLog("result: %s", respData)
-	result := respData.String()
-	if result == "" {
-		return "", log.NewWarn("nothing recognized")
+	result := &Result{
+		Text:       respData.String(),
+		Direction:  respData.Direction,
+		Confidence: respData.confidence(),
+		Duration:   time.Since(start),
+		Endpoint:   endpoint,
+		Lines:      respData.lines(),
+	}
+	if result.Text == "" {
+		return nil, log.NewWarn("nothing recognized")
 	}
 	return result, nil
 }
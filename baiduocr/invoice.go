@@ -0,0 +1,113 @@
+package baiduocr
+
+import (
+	"net/url"
+	"yangsi/log"
+)
+
+const (
+	InvoiceEndpoint = "https://aip.baidubce.com/rest/2.0/ocr/v1/vat_invoice"
+	ReceiptEndpoint = "https://aip.baidubce.com/rest/2.0/ocr/v1/shopping_receipt"
+)
+
+// Fields is what the invoice or the receipt APIs read; the same as the
+// package receipt stores, but as the API wrote it, e.g. "2020年01月02日".
+type Fields struct {
+	Merchant      string
+	Date          string
+	Total         string
+	Tax           string
+	InvoiceCode   string
+	InvoiceNumber string
+}
+
+type invoiceResult struct {
+	apiErrType
+	WordsResult struct {
+		InvoiceCode string `json:"InvoiceCode"`
+		InvoiceNum  string `json:"InvoiceNum"`
+		InvoiceDate string `json:"InvoiceDate"`
+		SellerName  string `json:"SellerName"`
+		TotalTax    string `json:"TotalTax"`
+		// 价税合计 in figures, the typo is the API's
+		AmountInFiguers string `json:"AmountInFiguers"`
+	} `json:"words_result"`
+}
+
+type word []struct {
+	Word string `json:"word"`
+}
+
+func (w word) String() string {
+	if len(w) == 0 {
+		return ""
+	}
+	return w[0].Word
+}
+
+type receiptResult struct {
+	apiErrType
+	WordsResult []struct {
+		ShopName        word `json:"shop_name"`
+		ConsumptionDate word `json:"consumption_date"`
+		TotalAmount     word `json:"total_amount"`
+		PaidAmount      word `json:"paid_amount"`
+		ReceiptNum      word `json:"receipt_num"`
+	} `json:"words_result"`
+}
+
+func request(endpoint string, imgData []byte, out apiError) error {
+	enc, err := encodeImg(imgData)
+	if err != nil {
+		return err
+	}
+	reqParams := url.Values{}
+	reqParams.Set("image", string(enc))
+	<-limiter.C
+	return post(endpoint, []byte(reqParams.Encode()), out)
+}
+
+// Invoice reads a Chinese VAT invoice with the vat_invoice API.
+func Invoice(imgData []byte) (*Fields, error) {
+	var respData invoiceResult
+	err := request(InvoiceEndpoint, imgData, &respData)
+	if err != nil {
+		return nil, err
+	}
+	w := &respData.WordsResult
+	if w.InvoiceNum == "" && w.AmountInFiguers == "" {
+		return nil, log.NewWarn("no invoice recognized")
+	}
+	return &Fields{
+		Merchant:      w.SellerName,
+		Date:          w.InvoiceDate,
+		Total:         w.AmountInFiguers,
+		Tax:           w.TotalTax,
+		InvoiceCode:   w.InvoiceCode,
+		InvoiceNumber: w.InvoiceNum,
+	}, nil
+}
+
+// Receipt reads a shop receipt with the shopping_receipt API. The amount
+// paid wins over the total, which is before discounts.
+func Receipt(imgData []byte) (*Fields, error) {
+	var respData receiptResult
+	err := request(ReceiptEndpoint, imgData, &respData)
+	if err != nil {
+		return nil, err
+	}
+	if len(respData.WordsResult) == 0 {
+		return nil, log.NewWarn("no receipt recognized")
+	}
+	w := &respData.WordsResult[0]
+	fields := &Fields{
+		Merchant:      w.ShopName.String(),
+		Date:          w.ConsumptionDate.String(),
+		Total:         w.PaidAmount.String(),
+		InvoiceNumber: w.ReceiptNum.String(),
+	}
+	if fields.Total == "" {
+		fields.Total = w.TotalAmount.String()
+	}
+	return fields, nil
+}
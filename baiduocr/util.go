@@ -3,11 +3,13 @@ package baiduocr
 import (
 	"encoding/base64"
 	"encoding/json"
+	"time"
 	"yangsi/log"
 )
 
 const (
 	fourMegabyte = 1024 * 1024 * 4
+	defaultQPS   = 5
 )
 
 func encodeImg(origin []byte) ([]byte, error) {
@@ -28,6 +30,7 @@ type config struct {
 		ClientSecret string `json:"client_secret"`
 	} `json:"token_auth"`
 	TokenFile string `json:"token_file"`
+	QPS       int    `json:"qps"`
 }
 
 func (c *config) check() error {
@@ -45,10 +48,14 @@ func Init(cfg json.RawMessage) error {
 	if err != nil {
 		return log.NewError("init config failed: %s", err.Error())
 	}
+	if localConf.QPS <= 0 {
+		localConf.QPS = defaultQPS
+	}
 	err = localConf.check()
 	if err != nil {
 		return err
 	}
+	limiter = time.NewTicker(time.Second / time.Duration(localConf.QPS))
 	tmpToken, err := getToken()
 	if err != nil {
 		return err
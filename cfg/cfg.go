@@ -12,6 +12,7 @@ import (
 const (
 	defaultOCRConfig = `{
 	"token_file": "./token",
+	"qps": 5,
 	"token_auth":{
 		"grant_type": "client_credentials",
 		"client_id": "",
@@ -19,15 +20,53 @@ const (
 	}
 }`
 	defaultDBConfig = `{
+	"driver": "sqlite3",
 	"db_name": "./default.db",
-	"tb_name": "yangsi"
+	"tb_name": "yangsi",
+	"pinyin": true
 }`
 	defaultIMGConfig = `{
 	"out_dir": "%s/out",
 	"out_img": {
 		"max_pixel": 1920,
 		"quality": 75
+	},
+	"decode": {
+		"max_pixels": 100000000,
+		"memory_mb": 512
+	},
+	"crop": [],
+	"frames": {
+		"max": 5,
+		"ffmpeg": "ffmpeg"
 	}
+}`
+	// tagging rules, see package rule
+	defaultRulesConfig = `[]`
+	// which records are invoices and receipts, see package receipt
+	defaultReceiptConfig = `{
+	"invoice_tags": ["invoice", "发票"],
+	"receipt_tags": ["receipt", "小票"],
+	"detect": true,
+	"api": false
+}`
+	// entity kinds masked in the stored text and archived images, see
+	// package redact
+	defaultRedactConfig = `{
+	"kinds": [],
+	"image": true
+}`
+	// what is done with the originals, see package dispose
+	defaultDispositionConfig = `{
+	"mode": "delete",
+	"processed_dir": "./processed",
+	"trash_dir": "",
+	"quarantine_dir": ""
+}`
+	// how files that failed are tried again, see package retry
+	defaultRetryConfig = `{
+	"max_attempts": 3,
+	"backoff_minutes": 10
 }`
 	defaultRootDir = "./origin"
 )
@@ -37,6 +76,13 @@ type global struct {
 	OCR  json.RawMessage `json:"ocr"`
 	DB   json.RawMessage `json:"db"`
 	IMG  json.RawMessage `json:"img"`
+	// optional
+	Rules   json.RawMessage `json:"rules,omitempty"`
+	Receipt json.RawMessage `json:"receipt,omitempty"`
+	Redact  json.RawMessage `json:"redact,omitempty"`
+	// delete when left out
+	Disposition json.RawMessage `json:"disposition,omitempty"`
+	Retry       json.RawMessage `json:"retry,omitempty"`
 }
 
 const path = "./conf.json"
@@ -87,9 +133,14 @@ func imgConf() (json.RawMessage, error) {
 
 func generate() (*global, error) {
 	var conf = &global{
-		Root: defaultRootDir,
-		DB:   json.RawMessage(defaultDBConfig),
-		OCR:  json.RawMessage(defaultOCRConfig),
+		Root:        defaultRootDir,
+		DB:          json.RawMessage(defaultDBConfig),
+		OCR:         json.RawMessage(defaultOCRConfig),
+		Rules:       json.RawMessage(defaultRulesConfig),
+		Receipt:     json.RawMessage(defaultReceiptConfig),
+		Redact:      json.RawMessage(defaultRedactConfig),
+		Disposition: json.RawMessage(defaultDispositionConfig),
+		Retry:       json.RawMessage(defaultRetryConfig),
 	}
 	var err error
 	conf.IMG, err = imgConf()
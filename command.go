@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	need  int
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"run", "walk the root dir once and index every image", needOCR | needDB | needIMG | needRules | needReceipt | needRedact | needDispose | needRetry, run},
+	{"watch", "index every image put in the root dir as it comes: watch [-settle 2s] [-rescan 10m]", needOCR | needDB | needIMG | needRules | needReceipt | needRedact | needDispose | needRetry, watch},
+	{"failures", "show or retry failed files: failures list [-stage s] [-all] | retry [-stage s] [path]...", needDB | needDispose, failuresCommand},
+	{"search", "search the index: search [flags] <terms>", needDB, search},
+	{"export", "export records: export [flags] [terms], -format jsonl, csv, md or html", needDB, export},
+	{"tag", "tag records: tag add <id> <tag>... | rm <id> <tag>... | list [id]", needDB, tagCommand},
+	{"note", "show or set the note of a record: note <id> [text]", needDB, note},
+	{"edit", "correct the text of a record in $EDITOR: edit <id>", needDB, edit},
+	{"retag", "apply the tagging rules to every record again: retag [-dry-run]", needDB | needRules, retag},
+	{"extract", "find phones, amounts, dates and the like in every record again: extract [-dry-run]", needDB, extract},
+	{"receipt", "read invoices and receipts: receipt parse [-dry-run] [id]... | export [flags] [terms]", needDB | needReceipt, receiptCommand},
+	{"reocr", "recognize stored images again: reocr [flags] [terms]", needOCR | needDB | needIMG | needRedact, reocr},
+	{"import", "merge another database: import -out-dir <dir> <other.db>", needDB | needIMG, importDB},
+	{"db", "maintain the database: db migrate [-dry-run] | backup <dest> | vacuum | check", needDBOpen | needIMG, dbCommand},
+}
+
+func findCommand(name string) *command {
+	for k := range commands {
+		if commands[k].name == name {
+			return &commands[k]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] [args]\n\ncommands:\n", os.Args[0])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// parseArgs parses flags anywhere among the positional arguments, which the
+// flag package alone stops at, and returns the positional ones.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		err := fs.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return rest, nil
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
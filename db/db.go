@@ -4,19 +4,22 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"strings"
 	"yangsi/log"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/longbridgeapp/opencc"
 )
 
 type config struct {
+	// sqlite3 by default, or postgres with db_name a connection string
+	Driver string `json:"driver"`
 	DBName string `json:"db_name"`
 	TBName string `json:"tb_name"`
+	// also match the pinyin of Chinese text, see fts.go
+	Pinyin bool `json:"pinyin"`
 }
 
 func (c *config) check() error {
-	if c.DBName == "" || c.TBName == "" {
+	if c.DBName == "" || c.TBName == "" || newDialect(c.Driver) == nil {
 		return log.NewError("invalid db config: %+v", *c)
 	}
 	return nil
@@ -28,17 +31,25 @@ var (
 
 const (
 	ctbTpl = "CREATE TABLE IF NOT EXISTS `%s` (`id` INTEGER PRIMARY KEY,`time` DATETIME NOT NULL,`path` VARCHAR(512) NOT NULL DEFAULT '',`text` TEXT)"
-	insTpl = "INSERT INTO `%s`(`time`,`path`,`text`) VALUES(?,?,?)"
-	qryTpl = "SELECT `id`,`time`,`path`,`text` FROM `%s` WHERE `text` LIKE ?"
+	updTpl = "UPDATE `%s` SET `time`=?,`path`=?,`text`=?,`orig_path`=?,`orig_name`=?,`size`=?,`width`=?,`height`=?,`format`=?,`sha256`=?,`ocr_engine`=?,`ocr_endpoint`=?,`ocr_ms`=?,`processed_at`=?,`direction`=?,`confidence`=?,`note`=?,`corrected_text`=?,`camera`=?,`disposition`=?,`disposed_path`=?,`state`=? WHERE `id`=?"
+	insTpl = "INSERT INTO `%s`(`time`,`path`,`text`,`orig_path`,`orig_name`,`size`,`width`,`height`,`format`,`sha256`,`ocr_engine`,`ocr_endpoint`,`ocr_ms`,`processed_at`,`direction`,`confidence`,`note`,`corrected_text`,`camera`,`disposition`,`disposed_path`,`state`) VALUES(?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)"
+
+	// decoded QR codes and barcodes, several per row of the main table
+	ctbCodeTpl  = "CREATE TABLE IF NOT EXISTS `%s_code` (`id` INTEGER PRIMARY KEY,`record_id` INTEGER NOT NULL,`format` VARCHAR(32) NOT NULL DEFAULT '',`payload` TEXT)"
+	cidxCodeTpl = "CREATE INDEX IF NOT EXISTS `%[1]s_code_record` ON `%[1]s_code`(`record_id`)"
+	insCodeTpl  = "INSERT INTO `%s_code`(`record_id`,`format`,`payload`) VALUES(?,?,?)"
 )
 
 var (
-	createSentence string
 	insertSentence string
-	querySentence  string
+	updateSentence string
+
+	insertCodeSentence string
 )
 
-func Init(cfgStr json.RawMessage) error {
+// Open opens the database without touching its schema.
+func Open(cfgStr json.RawMessage) error {
+	localConf.Driver = driverSQLite
 	err := json.Unmarshal(cfgStr, &localConf)
 	if err != nil {
 		return log.NewError("unmarshal db config failed: %s, %s", string(cfgStr), err.Error())
@@ -47,63 +58,92 @@ func Init(cfgStr json.RawMessage) error {
 	if err != nil {
 		return err
 	}
-	db, err = sql.Open("sqlite3", localConf.DBName)
+	t2s, err = opencc.New("t2s")
 	if err != nil {
-		return log.NewError("open sqlite failed: %s", localConf.DBName)
+		return log.NewError("load opencc t2s failed: %s", err.Error())
 	}
-	createSentence = fmt.Sprintf(ctbTpl, localConf.TBName)
-	insertSentence = fmt.Sprintf(insTpl, localConf.TBName)
-	querySentence = fmt.Sprintf(qryTpl, localConf.TBName)
-	_, err = db.Exec(createSentence)
+	dia = newDialect(localConf.Driver)
+	db, err = sql.Open(localConf.Driver, localConf.DBName)
 	if err != nil {
-		return log.NewError("create table failed: %s", err.Error())
+		return log.NewError("open %s failed: %s", localConf.Driver, localConf.DBName)
 	}
+	insertSentence = sq(fmt.Sprintf(insTpl, localConf.TBName))
+	updateSentence = sq(fmt.Sprintf(updTpl, localConf.TBName))
+	insertCodeSentence = sq(fmt.Sprintf(insCodeTpl, localConf.TBName))
 	return nil
 }
 
+// Init opens the database and migrates it to the current schema.
+func Init(cfgStr json.RawMessage) error {
+	err := Open(cfgStr)
+	if err != nil {
+		return err
+	}
+	_, err = Migrate(false)
+	if err != nil {
+		return err
+	}
+	index, err = dia.index().init()
+	return err
+}
+
 var (
 	db *sql.DB
 )
 
-func Get() *sql.DB {
+// DB is the handle to begin transactions on.
+func DB() *sql.DB {
 	return db
 }
 
-func insert(tx *sql.Tx, modtime, path, text string) error {
-	_, err := tx.Exec(insertSentence, modtime, path, text)
+func insert(tx *sql.Tx, r *Record) (int64, error) {
+	id, err := dia.insert(tx, insertSentence, formatTime(r.Time), r.Path, r.Text, r.OrigPath, r.OrigName,
+		r.Size, r.Width, r.Height, r.Format, r.SHA256, r.OCREngine, r.OCREndpoint, r.OCRMillis,
+		nullTime(r.ProcessedAt), r.Direction, r.Confidence, r.Note, r.CorrectedText, r.Camera,
+		r.Disposition, r.DisposedPath, r.State)
 	if err != nil {
-		return log.NewError("insert failed: %s", err.Error())
+		return 0, log.NewError("insert failed: %s", err.Error())
 	}
-	return nil
+	r.ID = id
+	return id, index.insert(tx, id, document(r.Text, r.CorrectedText, r.Note, nil))
+}
+
+func insertCode(tx *sql.Tx, id int64, format, payload string) error {
+	_, err := tx.Exec(insertCodeSentence, id, format, payload)
+	if err != nil {
+		return log.NewError("insert code failed: %s", err.Error())
+	}
+	return index.insertCode(tx, id, payload)
+}
+
+///////////////////////////
+// Insert adds r as a new row and sets its ID.
+func Insert(tx *sql.Tx, r *Record) (int64, error) {
+	return insert(tx, r)
+}
+
+// InsertCode stores a QR code or barcode payload decoded from the image of
+// row id.
+func InsertCode(tx *sql.Tx, id int64, format, payload string) error {
+	return insertCode(tx, id, format, payload)
 }
 
-func query(str string) ([][3]string, error) {
-	rows, err := db.Query(querySentence, str)
+// Codes returns the codes decoded from the image of row id in the order they
+// were stored.
+func Codes(id int64) ([]Code, error) {
+	rows, err := db.Query(sq(fmt.Sprintf("SELECT `format`,COALESCE(`payload`,'') FROM `%s_code` WHERE `record_id`=? ORDER BY `id`", localConf.TBName)), id)
 	if err != nil {
-		return nil, log.NewError("query failed: %s", err.Error())
+		return nil, log.NewError("query codes failed: %s", err.Error())
 	}
 	defer rows.Close()
-	var result = make([][3]string, 16)
-	var tmp [3]string
+	var codes []Code
 	for rows.Next() {
-		err = rows.Scan(&tmp[0], &tmp[1], &tmp[2])
+		var c Code
+		err = rows.Scan(&c.Format, &c.Payload)
 		if err != nil {
-			return nil, log.NewError("scan rows failed: %s", err.Error())
+			return nil, log.NewError("scan codes failed: %s", err.Error())
 		}
-		result = append(result, tmp)
-	}
-	return result, nil
-}
-
-func Query(str string) ([][3]string, error) {
-	str = strings.TrimSpace(str)
-	if str == "" {
-		return nil, nil
+		codes = append(codes, c)
 	}
-	return query(str)
-}
-
-///////////////////////////
-func Insert(tx *sql.Tx, modtime, path, text string) error {
-	return insert(tx, modtime, path, text)
+	return codes, rows.Err()
 }
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostgresSentence(t *testing.T) {
+	var tests = []struct {
+		in, want string
+	}{
+		{"SELECT `id` FROM `t` WHERE `path`=?", `SELECT "id" FROM "t" WHERE "path"=$1`},
+		{"UPDATE `t` SET `a`=?,`b`=? WHERE `id`=?", `UPDATE "t" SET "a"=$1,"b"=$2 WHERE "id"=$3`},
+		{"SELECT `id` FROM `t` WHERE `text` LIKE ? ESCAPE '\\'", `SELECT "id" FROM "t" WHERE "text" LIKE $1 ESCAPE '\'`},
+		{"SELECT 'what?' FROM `t` WHERE `id`=?", `SELECT 'what?' FROM "t" WHERE "id"=$1`},
+		{"SELECT '`x`' WHERE `a`=?", `SELECT '` + "`x`" + `' WHERE "a"=$1`},
+		{"SELECT 'it''s ?' WHERE `a`=? AND `b`='?'", `SELECT 'it''s ?' WHERE "a"=$1 AND "b"='?'`},
+		{"INSERT INTO `t`(`a`,`b`) VALUES(?,'')", `INSERT INTO "t"("a","b") VALUES($1,'')`},
+		{"SELECT `名字` FROM `表` WHERE `x`=?", `SELECT "名字" FROM "表" WHERE "x"=$1`},
+	}
+	for _, tt := range tests {
+		if got := (postgresDialect{}).sentence(tt.in); got != tt.want {
+			t.Errorf("sentence(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSQLiteSentence(t *testing.T) {
+	in := "SELECT `id` FROM `t` WHERE `path`=? AND `note`='?'"
+	if got := (sqliteDialect{}).sentence(in); got != in {
+		t.Errorf("sentence(%s) = %s, want it as it is", in, got)
+	}
+}
+
+// TestPostgres migrates and searches a table of its own in the database of
+// YANGSI_TEST_POSTGRES, a connection string, and drops it afterwards.
+func TestPostgres(t *testing.T) {
+	dsn := os.Getenv("YANGSI_TEST_POSTGRES")
+	if dsn == "" {
+		t.Skip("YANGSI_TEST_POSTGRES not set")
+	}
+	tb := fmt.Sprintf("yangsi_test_%d", time.Now().UnixNano())
+	err := Init([]byte(fmt.Sprintf(`{"driver":"postgres","db_name":%q,"tb_name":%q}`, dsn, tb)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropPostgres(t, tb)
+
+	err = CheckSchema()
+	if err != nil {
+		t.Errorf("check schema: %v", err)
+	}
+	applied, err := Migrate(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("migrated again: %v", applied)
+	}
+
+	r := &Record{Time: time.Now(), Path: "./a.jpg", Text: "微信支付 100元", Format: "jpeg"}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Insert(tx, r)
+	if err == nil {
+		err = InsertCode(tx, r.ID, "QR_CODE", "https://example.com/?a=1")
+	}
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	find := func(terms ...string) int {
+		records, err := Find(&Filter{Terms: terms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(records)
+	}
+	for _, term := range []string{"微信", "支付", "example"} {
+		if n := find(term); n != 1 {
+			t.Errorf("find %s: %d rows, want 1", term, n)
+		}
+	}
+
+	r.Text = "支付宝"
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Update(tx, r)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := find("微信"); n != 0 {
+		t.Errorf("find old text after update: %d rows, want 0", n)
+	}
+	if n := find("支付宝"); n != 1 {
+		t.Errorf("find new text after update: %d rows, want 1", n)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Delete(tx, r.ID)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := find("支付宝"); n != 0 {
+		t.Errorf("find after delete: %d rows, want 0", n)
+	}
+}
+
+// dropPostgres drops the tables of tb and forgets its schema versions.
+func dropPostgres(t *testing.T, tb string) {
+	defer db.Close()
+	rows, err := db.Query("SELECT table_name FROM information_schema.tables WHERE table_schema=current_schema() AND (table_name=$1 OR table_name LIKE $2)", tb, tb+`\_%`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var tables []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			t.Error(err)
+		}
+		tables = append(tables, `"`+name+`"`)
+	}
+	rows.Close()
+	if len(tables) > 0 {
+		_, err = db.Exec("DROP TABLE IF EXISTS " + strings.Join(tables, ",") + " CASCADE")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	_, err = db.Exec(`DELETE FROM "schema_version" WHERE "tb_name"=$1`, tb)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"yangsi/log"
+)
+
+const (
+	// phone numbers, amounts, dates and the like found in the text
+	ctbEntityTpl      = "CREATE TABLE IF NOT EXISTS `%[1]s_entity` (`id` INTEGER PRIMARY KEY,`record_id` INTEGER NOT NULL,`kind` VARCHAR(16) NOT NULL,`value` VARCHAR(256) NOT NULL,`raw` VARCHAR(256) NOT NULL DEFAULT '')"
+	cidxEntityTpl     = "CREATE INDEX IF NOT EXISTS `%[1]s_entity_value` ON `%[1]s_entity`(`kind`,`value`)"
+	cidxEntityRecTpl  = "CREATE INDEX IF NOT EXISTS `%[1]s_entity_record` ON `%[1]s_entity`(`record_id`)"
+	insEntityTpl      = "INSERT INTO `%s_entity`(`record_id`,`kind`,`value`,`raw`) VALUES(?,?,?,?)"
+	qryRecordEntities = "SELECT `kind`,`value`,`raw` FROM `%s_entity` WHERE `record_id`=? ORDER BY `id`"
+)
+
+// Entity is a typed value found in the text of a row, see package entity.
+type Entity struct {
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+	// as it is in the text
+	Raw string `json:"raw"`
+}
+
+// EntityFilter selects rows with an entity of Kind whose value starts with
+// Value, or with any entity of Kind when Value is "".
+type EntityFilter struct {
+	Kind  string
+	Value string
+}
+
+// ParseEntityFilter reads "kind:value" or "kind".
+func ParseEntityFilter(s string) EntityFilter {
+	kind, value := s, ""
+	if k := strings.IndexAny(s, ":："); k >= 0 {
+		kind, value = s[:k], strings.TrimLeft(s[k:], ":：")
+	}
+	return EntityFilter{strings.ToLower(strings.TrimSpace(kind)), strings.TrimSpace(value)}
+}
+
+// SetEntities replaces the entities of the row id.
+func SetEntities(tx *sql.Tx, id int64, entities []Entity) error {
+	tb := localConf.TBName
+	_, err := tx.Exec(sq(fmt.Sprintf("DELETE FROM `%s_entity` WHERE `record_id`=?", tb)), id)
+	if err != nil {
+		return log.NewError("delete entities failed: %d, %s", id, err.Error())
+	}
+	for _, e := range entities {
+		_, err = tx.Exec(sq(fmt.Sprintf(insEntityTpl, tb)), id, e.Kind, e.Value, e.Raw)
+		if err != nil {
+			return log.NewError("insert entity failed: %d, %s", id, err.Error())
+		}
+	}
+	return nil
+}
+
+// Entities returns the entities of the row id in the order they were found.
+func Entities(id int64) ([]Entity, error) {
+	rows, err := db.Query(sq(fmt.Sprintf(qryRecordEntities, localConf.TBName)), id)
+	if err != nil {
+		return nil, log.NewError("query entities failed: %d, %s", id, err.Error())
+	}
+	defer rows.Close()
+	var result []Entity
+	for rows.Next() {
+		var e Entity
+		err = rows.Scan(&e.Kind, &e.Value, &e.Raw)
+		if err != nil {
+			return nil, log.NewError("scan entities failed: %d, %s", id, err.Error())
+		}
+		result = append(result, e)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"yangsi/log"
+)
+
+const (
+	// every failed attempt at a file, kept after it is stored in the end
+	ctbFailureTpl  = "CREATE TABLE IF NOT EXISTS `%[1]s_failure` (`id` INTEGER PRIMARY KEY,`path` VARCHAR(1024) NOT NULL,`stage` VARCHAR(16) NOT NULL,`class` VARCHAR(16) NOT NULL,`error` TEXT NOT NULL DEFAULT '',`quarantined` VARCHAR(1024) NOT NULL DEFAULT '',`time` TIMESTAMP NOT NULL)"
+	cidxFailureTpl = "CREATE INDEX IF NOT EXISTS `%[1]s_failure_path` ON `%[1]s_failure`(`path`)"
+
+	failureColumns = "`id`,`path`,`stage`,`class`,`error`,`quarantined`,`time`"
+)
+
+// Stages a file fails at.
+const (
+	StageLoad   = "load"
+	StageResize = "resize"
+	StageOCR    = "ocr"
+	// blacking out what redaction located in the archived copy
+	StageRedact = "redact"
+	// writing the archived copy and disposing of the original
+	StageStore = "store"
+	StageDB    = "db"
+)
+
+// Stages lists the stages in order.
+var Stages = []string{StageLoad, StageResize, StageOCR, StageRedact, StageStore, StageDB}
+
+// Classes of failures, which say whether the next runs try again.
+const (
+	// the OCR service or the network, tried again by the next run
+	Transient = "transient"
+	// the file itself, which can't be decoded; tried again only when asked
+	Permanent = "permanent"
+	// anything else, tried again as the retry policy says
+	OtherError = "error"
+)
+
+// Failure is a failed attempt at the file at Path.
+type Failure struct {
+	ID    int64
+	Path  string
+	Stage string
+	Class string
+	Error string
+	// where the file was moved to, "" if it wasn't
+	Quarantined string
+	Time        time.Time
+}
+
+// Failed records a failed attempt at the file of a job and counts it.
+func Failed(f *Failure) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return log.NewError("begin failed: %s", err.Error())
+	}
+	defer tx.Rollback()
+	err = updateJob(tx, f.Path, "`status`=?,`attempts`=`attempts`+1,`last_error`=?,`stage`=?,`class`=?",
+		JobFailed, f.Error, f.Stage, f.Class)
+	if err != nil {
+		return err
+	}
+	f.ID, err = dia.insert(tx, sq(fmt.Sprintf("INSERT INTO `%s_failure`(`path`,`stage`,`class`,`error`,`quarantined`,`time`) VALUES(?,?,?,?,?,?)", localConf.TBName)),
+		f.Path, f.Stage, f.Class, f.Error, f.Quarantined, formatTime(f.Time))
+	if err != nil {
+		return log.NewError("insert failure failed: %s, %s", f.Path, err.Error())
+	}
+	err = tx.Commit()
+	if err != nil {
+		return log.NewError("commit failed: %s", err.Error())
+	}
+	return nil
+}
+
+// Failures returns the failures at stage, or at any stage when it is "",
+// oldest first. With all it returns every one recorded, else only the last
+// one of each file still failed.
+func Failures(stage string, all bool) ([]Failure, error) {
+	tb := localConf.TBName
+	sentence := fmt.Sprintf("SELECT %s FROM `%s_failure` f WHERE 1=1", failureColumns, tb)
+	var args []interface{}
+	if !all {
+		sentence += fmt.Sprintf(" AND `id`=(SELECT MAX(`id`) FROM `%[1]s_failure` WHERE `path`=f.`path`)"+
+			" AND `path` IN (SELECT `path` FROM `%[1]s_job` WHERE `status`=?)", tb)
+		args = append(args, JobFailed)
+	}
+	if stage != "" {
+		sentence += " AND `stage`=?"
+		args = append(args, stage)
+	}
+	rows, err := db.Query(sq(sentence+" ORDER BY `id`"), args...)
+	if err != nil {
+		return nil, log.NewError("query failures failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var result []Failure
+	for rows.Next() {
+		var f Failure
+		err = rows.Scan(&f.ID, &f.Path, &f.Stage, &f.Class, &f.Error, &f.Quarantined, &f.Time)
+		if err != nil {
+			return nil, log.NewError("scan failure failed: %s", err.Error())
+		}
+		f.Time = wallClock(f.Time)
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
+
+// LastFailure returns the last failure of the file at path, nil if it never
+// failed.
+func LastFailure(path string) (*Failure, error) {
+	var f Failure
+	err := db.QueryRow(sq(fmt.Sprintf("SELECT %s FROM `%s_failure` WHERE `path`=? ORDER BY `id` DESC LIMIT 1", failureColumns, localConf.TBName)), path).
+		Scan(&f.ID, &f.Path, &f.Stage, &f.Class, &f.Error, &f.Quarantined, &f.Time)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, log.NewError("query failure failed: %s, %s", path, err.Error())
+	}
+	f.Time = wallClock(f.Time)
+	return &f, nil
+}
@@ -0,0 +1,204 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode"
+	"yangsi/log"
+)
+
+// The full-text index is an FTS5 table whose rowid is the id of the main
+// table, written next to it by Insert and InsertCode. unicode61 only splits on
+// spaces and punctuation, which leaves a run of Chinese as one token, so text
+// is segmented in Go first: every CJK character becomes a token of its own by
+// surrounding it with zero width spaces, and a query term becomes a phrase of
+// those characters, which matches the same rows a bigram index would. The
+// text and codes columns hold the normalized text (see normalize.go), and
+// with pinyin enabled a shadow column holds the readings of its Chinese
+// characters, so that a term typed in pinyin matches them as a phrase of
+// syllables. Snippets are cut in Go (see query.go) rather than by snippet()
+// or highlight(), which could only give back the segmented, normalized text
+// the table holds and not mark pinyin matches in it.
+//
+// FTS5 is only compiled into go-sqlite3 with the sqlite_fts5 build tag:
+// build with go build -tags sqlite_fts5, and test it with go test -tags
+// sqlite_fts5 ./db. Without it the search table of index.go is used, which
+// matches the same terms by scanning and doesn't rank them.
+const (
+	// the pinyin column is left unindexed when pinyin is off; the statement
+	// differing is what tells init to rebuild the index after a switch
+	ftsCtbTpl  = "CREATE VIRTUAL TABLE `%s_fts` USING fts5(`text`,`codes`,`pinyin`%s,tokenize='unicode61')"
+	ftsInsTpl  = "INSERT INTO `%s_fts`(`rowid`,`text`,`codes`,`pinyin`) VALUES(?,?,'',?)"
+	ftsCodeTpl = "UPDATE `%s_fts` SET `codes`=`codes`||? WHERE `rowid`=?"
+	ftsUpdTpl  = "UPDATE `%s_fts` SET `text`=?,`pinyin`=? WHERE `rowid`=?"
+	ftsDelTpl  = "DELETE FROM `%s_fts` WHERE `rowid`=?"
+
+	separator = "\u200b"
+)
+
+// ftsIndex is the FTS5 table `<tb_name>_fts`.
+type ftsIndex struct {
+	insertSentence string
+	codeSentence   string
+	updateSentence string
+	deleteSentence string
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// segment turns every CJK character of s into a token of its own.
+func segment(s string) string {
+	var buf strings.Builder
+	var prevCJK bool
+	for k, r := range s {
+		cjk := isCJK(r)
+		if k > 0 && (cjk || prevCJK) {
+			buf.WriteString(separator)
+		}
+		buf.WriteRune(r)
+		prevCJK = cjk
+	}
+	return buf.String()
+}
+
+func quotePhrase(s string) string {
+	return `"` + strings.Replace(s, `"`, `""`, -1) + `"*`
+}
+
+// ftsQuery builds a MATCH expression requiring every term, each as a phrase
+// whose last token may be a prefix, found in the text or codes or, when the
+// term reads as pinyin, in the pinyin column.
+func ftsQuery(terms []string) string {
+	var phrases = make([]string, 0, len(terms))
+	for _, term := range terms {
+		norm := string(normalize(term))
+		phrase := "{text codes} : " + quotePhrase(segment(norm))
+		if localConf.Pinyin {
+			if pieces := splitPinyin(norm); pieces != nil {
+				phrase = "(" + phrase + " OR pinyin : " + quotePhrase(strings.Join(pieces, " ")) + ")"
+			}
+		}
+		phrases = append(phrases, phrase)
+	}
+	return strings.Join(phrases, " AND ")
+}
+
+// indexText returns what the text and pinyin columns hold for a text.
+func indexText(text string) (string, string) {
+	norm := normalize(text)
+	if !localConf.Pinyin {
+		return segment(string(norm)), ""
+	}
+	return segment(string(norm)), pinyinText(norm)
+}
+
+func indexCode(payload string) string {
+	return " " + segment(string(normalize(payload)))
+}
+
+// init creates the index and rebuilds it when it misses rows, e.g. written
+// by a build without FTS5, or was created with other columns. Without FTS5 it
+// falls back to the search table.
+func (ix *ftsIndex) init() (textIndex, error) {
+	tb := localConf.TBName
+	ix.insertSentence = fmt.Sprintf(ftsInsTpl, tb)
+	ix.codeSentence = fmt.Sprintf(ftsCodeTpl, tb)
+	ix.updateSentence = fmt.Sprintf(ftsUpdTpl, tb)
+	ix.deleteSentence = fmt.Sprintf(ftsDelTpl, tb)
+	var unindexed string
+	if !localConf.Pinyin {
+		unindexed = " UNINDEXED"
+	}
+	createFTS := fmt.Sprintf(ftsCtbTpl, tb, unindexed)
+	var missing int64
+	err := recreateFTS(createFTS)
+	if err == nil {
+		// an index created by an FTS5 build still exists without the module,
+		// so only reading it tells whether it can be used
+		err = db.QueryRow(fmt.Sprintf("SELECT (SELECT COUNT(*) FROM `%s`)-(SELECT COUNT(*) FROM `%s_fts`)", tb, tb)).Scan(&missing)
+	}
+	if err != nil {
+		log.WarnLog("full-text index disabled, search scans the search table: %s", err.Error())
+		return (&searchIndex{}).init()
+	}
+	// the search table isn't kept up to date meanwhile, so that a build
+	// without FTS5 fills it again
+	_, err = db.Exec(fmt.Sprintf("DROP TABLE IF EXISTS `%s_search`", tb))
+	if err != nil {
+		return nil, log.NewError("drop search table failed: %s", err.Error())
+	}
+	if missing != 0 {
+		return ix, rebuild(ix, fmt.Sprintf("DELETE FROM `%s_fts`", tb))
+	}
+	return ix, nil
+}
+
+// recreateFTS creates the index unless it exists with the same statement,
+// dropping an outdated one first.
+func recreateFTS(createFTS string) error {
+	var current string
+	err := db.QueryRow("SELECT `sql` FROM `sqlite_master` WHERE `type`='table' AND `name`=?", localConf.TBName+"_fts").Scan(&current)
+	if err == nil && current == createFTS {
+		return nil
+	}
+	if err == nil {
+		log.InfoLog("full-text index of %s is outdated, dropping it", localConf.TBName)
+		_, err = db.Exec(fmt.Sprintf("DROP TABLE `%s_fts`", localConf.TBName))
+		if err != nil {
+			return err
+		}
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	_, err = db.Exec(createFTS)
+	return err
+}
+
+func (ix *ftsIndex) insert(tx *sql.Tx, id int64, text string) error {
+	text, py := indexText(text)
+	_, err := tx.Exec(ix.insertSentence, id, text, py)
+	if err != nil {
+		return log.NewError("index row failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+func (ix *ftsIndex) insertCode(tx *sql.Tx, id int64, payload string) error {
+	_, err := tx.Exec(ix.codeSentence, indexCode(payload), id)
+	if err != nil {
+		return log.NewError("index code failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+func (ix *ftsIndex) update(tx *sql.Tx, id int64, text string) error {
+	text, py := indexText(text)
+	_, err := tx.Exec(ix.updateSentence, text, py, id)
+	if err != nil {
+		return log.NewError("reindex row failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+func (ix *ftsIndex) delete(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec(ix.deleteSentence, id)
+	if err != nil {
+		return log.NewError("unindex row failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+func (ix *ftsIndex) join() string {
+	return fmt.Sprintf(" JOIN `%[1]s_fts` ON `%[1]s_fts`.`rowid`=`%[1]s`.`id`", localConf.TBName)
+}
+
+func (ix *ftsIndex) match(terms []string) (string, []interface{}) {
+	return fmt.Sprintf("`%s_fts` MATCH ?", localConf.TBName), []interface{}{ftsQuery(terms)}
+}
+
+func (ix *ftsIndex) rank() string {
+	return fmt.Sprintf("bm25(`%s_fts`)", localConf.TBName)
+}
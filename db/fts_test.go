@@ -0,0 +1,88 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFTS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t","pinyin":true}`, filepath.Join(dir, "t.db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, ok := index.(*ftsIndex); !ok {
+		t.Fatalf("index %T, want FTS5", index)
+	}
+
+	texts := []string{
+		"报销单 附件若干 请财务部门审核后再处理 发票一张",
+		"发票 发票 发票",
+		"会议纪要",
+	}
+	var ids []int64
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, text := range texts {
+		// the later the newer, so that time alone would order them the other way
+		id, err := Insert(tx, &Record{Time: time.Unix(int64(1700000000+k), 0), Path: fmt.Sprintf("./%d.jpg", k), Text: text})
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hits, err := Query(&Filter{Terms: []string{"fapiao"}, Mark: [2]string{"[", "]"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 {
+		t.Fatalf("%d hits, want 2", len(hits))
+	}
+	// BM25 puts the row with the term three times in a short text first
+	if hits[0].ID != ids[1] || hits[1].ID != ids[0] {
+		t.Errorf("hits %d, %d, want %d, %d", hits[0].ID, hits[1].ID, ids[1], ids[0])
+	}
+	if hits[0].Rank >= hits[1].Rank {
+		t.Errorf("ranks %v, %v, want the first lower", hits[0].Rank, hits[1].Rank)
+	}
+	if want := "[发票] [发票] [发票]"; hits[0].Snippet != want {
+		t.Errorf("snippet %q, want %q", hits[0].Snippet, want)
+	}
+
+	// a row written while the index was missing is found after it is rebuilt
+	_, err = db.Exec("DELETE FROM `t_fts`")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = index.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := Find(&Filter{Terms: []string{"会议"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].ID != ids[2] {
+		t.Errorf("after rebuild: %v, want row %d", records, ids[2])
+	}
+}
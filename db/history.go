@@ -0,0 +1,91 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"yangsi/log"
+)
+
+const (
+	// the text a row had before each time it was recognized again
+	ctbHistoryTpl  = "CREATE TABLE IF NOT EXISTS `%[1]s_history` (`id` INTEGER PRIMARY KEY,`record_id` INTEGER NOT NULL,`text` TEXT,`ocr_engine` VARCHAR(32) NOT NULL DEFAULT '',`ocr_endpoint` VARCHAR(256) NOT NULL DEFAULT '',`confidence` REAL NOT NULL DEFAULT -1,`processed_at` DATETIME,`replaced_at` DATETIME NOT NULL)"
+	cidxHistoryTpl = "CREATE INDEX IF NOT EXISTS `%[1]s_history_record` ON `%[1]s_history`(`record_id`)"
+	insHistoryTpl  = "INSERT INTO `%[1]s_history`(`record_id`,`text`,`ocr_engine`,`ocr_endpoint`,`confidence`,`processed_at`,`replaced_at`) SELECT `id`,`text`,`ocr_engine`,`ocr_endpoint`,`confidence`,`processed_at`,? FROM `%[1]s` WHERE `id`=?"
+	qryHistoryTpl  = "SELECT `text`,`ocr_engine`,`ocr_endpoint`,`confidence`,`processed_at`,`replaced_at` FROM `%s_history` WHERE `record_id`=? ORDER BY `id`"
+)
+
+// Version is a text a row had before it was recognized again.
+type Version struct {
+	Text        string    `json:"text"`
+	OCREngine   string    `json:"ocr_engine"`
+	OCREndpoint string    `json:"ocr_endpoint"`
+	Confidence  float64   `json:"confidence"`
+	ProcessedAt time.Time `json:"processed_at"`
+	ReplacedAt  time.Time `json:"replaced_at"`
+}
+
+// Revise keeps the text of the row r.ID in the history and then updates the
+// row with r.
+func Revise(tx *sql.Tx, r *Record) error {
+	res, err := tx.Exec(sq(fmt.Sprintf(insHistoryTpl, localConf.TBName)), formatTime(time.Now()), r.ID)
+	if err != nil {
+		return log.NewError("keep history failed: %d, %s", r.ID, err.Error())
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.NewError("keep history failed: %d, %s", r.ID, err.Error())
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return Update(tx, r)
+}
+
+// History returns the previous texts of the row id, oldest first.
+func History(id int64) ([]Version, error) {
+	rows, err := db.Query(sq(fmt.Sprintf(qryHistoryTpl, localConf.TBName)), id)
+	if err != nil {
+		return nil, log.NewError("query history failed: %d, %s", id, err.Error())
+	}
+	defer rows.Close()
+	var result []Version
+	for rows.Next() {
+		var v Version
+		err = scanVersion(rows, &v)
+		if err != nil {
+			return nil, log.NewError("scan history failed: %d, %s", id, err.Error())
+		}
+		result = append(result, v)
+	}
+	return result, rows.Err()
+}
+
+func scanVersion(s scanner, v *Version) error {
+	var text sql.NullString
+	var processedAt sql.NullTime
+	err := s.Scan(&text, &v.OCREngine, &v.OCREndpoint, &v.Confidence, &processedAt, &v.ReplacedAt)
+	if err != nil {
+		return err
+	}
+	v.Text = text.String
+	v.ProcessedAt = time.Time{}
+	if processedAt.Valid {
+		v.ProcessedAt = wallClock(processedAt.Time)
+	}
+	v.ReplacedAt = wallClock(v.ReplacedAt)
+	return nil
+}
+
+// AddHistory appends versions to the history of the row id, as they were
+// kept by another database.
+func AddHistory(tx *sql.Tx, id int64, versions []Version) error {
+	sentence := sq(fmt.Sprintf("INSERT INTO `%s_history`(`record_id`,`text`,`ocr_engine`,`ocr_endpoint`,`confidence`,`processed_at`,`replaced_at`) VALUES(?,?,?,?,?,?,?)", localConf.TBName))
+	for _, v := range versions {
+		_, err := tx.Exec(sentence, id, v.Text, v.OCREngine, v.OCREndpoint, v.Confidence, nullTime(v.ProcessedAt), formatTime(v.ReplacedAt))
+		if err != nil {
+			return log.NewError("add history failed: %d, %s", id, err.Error())
+		}
+	}
+	return nil
+}
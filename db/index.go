@@ -0,0 +1,208 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"yangsi/log"
+)
+
+// textIndex finds the rows matching search terms. It is written next to the
+// main table, in the same transaction. The text it gets for a row is its
+// document: the recognized text with the corrected text, note and tags.
+type textIndex interface {
+	// init prepares the index and returns the one to use instead when it
+	// can't be used
+	init() (textIndex, error)
+	insert(tx *sql.Tx, id int64, text string) error
+	insertCode(tx *sql.Tx, id int64, payload string) error
+	update(tx *sql.Tx, id int64, text string) error
+	delete(tx *sql.Tx, id int64) error
+	// join is added to the FROM clause to match terms
+	join() string
+	// match is the condition requiring every term
+	match(terms []string) (string, []interface{})
+	// rank is the expression ordering the matches, best first, or ""
+	rank() string
+}
+
+var index textIndex = &searchIndex{}
+
+// Without a full-text index, i.e. SQLite built without FTS5 and PostgreSQL,
+// the text index is a table of the normalized text, codes and pinyin of every
+// row (see normalize.go), which a term becomes a LIKE '%term%' scan of, so
+// that it matches regardless of width, case and traditional characters, and
+// in pinyin when that is on. Matches are ordered by time.
+const (
+	searchCtbTpl  = "CREATE TABLE IF NOT EXISTS `%s_search` (`record_id` BIGINT PRIMARY KEY,`text` TEXT NOT NULL DEFAULT '',`codes` TEXT NOT NULL DEFAULT '',`pinyin` TEXT NOT NULL DEFAULT '')"
+	searchInsTpl  = "INSERT INTO `%s_search`(`record_id`,`text`,`pinyin`) VALUES(?,?,?)"
+	searchCodeTpl = "UPDATE `%s_search` SET `codes`=`codes`||? WHERE `record_id`=?"
+	searchUpdTpl  = "UPDATE `%s_search` SET `text`=?,`pinyin`=? WHERE `record_id`=?"
+	searchDelTpl  = "DELETE FROM `%s_search` WHERE `record_id`=?"
+)
+
+// searchIndex is the table `<tb_name>_search`.
+type searchIndex struct {
+	insertSentence string
+	codeSentence   string
+	updateSentence string
+	deleteSentence string
+}
+
+// init creates the table and rebuilds it when it misses rows, e.g. written
+// while another index was in use.
+func (ix *searchIndex) init() (textIndex, error) {
+	tb := localConf.TBName
+	ix.insertSentence = sq(fmt.Sprintf(searchInsTpl, tb))
+	ix.codeSentence = sq(fmt.Sprintf(searchCodeTpl, tb))
+	ix.updateSentence = sq(fmt.Sprintf(searchUpdTpl, tb))
+	ix.deleteSentence = sq(fmt.Sprintf(searchDelTpl, tb))
+	_, err := db.Exec(sq(fmt.Sprintf(searchCtbTpl, tb)))
+	if err != nil {
+		return nil, log.NewError("create search table failed: %s", err.Error())
+	}
+	var missing int64
+	err = db.QueryRow(sq(fmt.Sprintf("SELECT (SELECT COUNT(*) FROM `%s`)-(SELECT COUNT(*) FROM `%[1]s_search`)", tb))).Scan(&missing)
+	if err != nil {
+		return nil, log.NewError("count search table failed: %s", err.Error())
+	}
+	if missing != 0 {
+		return ix, rebuild(ix, fmt.Sprintf("DELETE FROM `%s_search`", tb))
+	}
+	return ix, nil
+}
+
+// pinyinWords lists the readings of the Chinese characters of the normalized
+// text between single spaces, so that a phrase of syllables is found with
+// LIKE '% wei xin%'. It is kept whether pinyin is on or not.
+func pinyinWords(norm []rune) string {
+	return " " + strings.Join(strings.Fields(pinyinText(norm)), " ") + " "
+}
+
+func (ix *searchIndex) insert(tx *sql.Tx, id int64, text string) error {
+	norm := normalize(text)
+	_, err := tx.Exec(ix.insertSentence, id, string(norm), pinyinWords(norm))
+	if err != nil {
+		return log.NewError("index row failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+func (ix *searchIndex) insertCode(tx *sql.Tx, id int64, payload string) error {
+	_, err := tx.Exec(ix.codeSentence, "\n"+string(normalize(payload)), id)
+	if err != nil {
+		return log.NewError("index code failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+func (ix *searchIndex) update(tx *sql.Tx, id int64, text string) error {
+	norm := normalize(text)
+	_, err := tx.Exec(ix.updateSentence, string(norm), pinyinWords(norm), id)
+	if err != nil {
+		return log.NewError("reindex row failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+func (ix *searchIndex) delete(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec(ix.deleteSentence, id)
+	if err != nil {
+		return log.NewError("unindex row failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+func (ix *searchIndex) join() string {
+	return fmt.Sprintf(" JOIN `%[1]s_search` ON `%[1]s_search`.`record_id`=`%[1]s`.`id`", localConf.TBName)
+}
+
+func (ix *searchIndex) match(terms []string) (string, []interface{}) {
+	tb := localConf.TBName
+	var conds = make([]string, 0, len(terms))
+	var args []interface{}
+	for _, term := range terms {
+		norm := string(normalize(term))
+		cond := fmt.Sprintf("`%[1]s_search`.`text` LIKE ? ESCAPE '%[2]s' OR `%[1]s_search`.`codes` LIKE ? ESCAPE '%[2]s'", tb, likeEscape)
+		args = append(args, likePattern(norm), likePattern(norm))
+		if localConf.Pinyin {
+			if pieces := splitPinyin(norm); pieces != nil {
+				cond += fmt.Sprintf(" OR `%s_search`.`pinyin` LIKE ? ESCAPE '%s'", tb, likeEscape)
+				args = append(args, likePattern(" "+strings.Join(pieces, " ")))
+			}
+		}
+		conds = append(conds, "("+cond+")")
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+func (ix *searchIndex) rank() string {
+	return ""
+}
+
+// rebuild clears an index and fills it again from the tables.
+func rebuild(ix textIndex, clear string) error {
+	tb := localConf.TBName
+	log.InfoLog("building full-text index of %s", tb)
+	tx, err := db.Begin()
+	if err != nil {
+		return log.NewError("begin failed: %s", err.Error())
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(sq(clear))
+	if err != nil {
+		return log.NewError("clear full-text index failed: %s", err.Error())
+	}
+	ids, _, err := scanTexts(tx, fmt.Sprintf("SELECT `id`,'' FROM `%s`", tb))
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		doc, err := rowDocument(tx, id)
+		if err != nil {
+			return err
+		}
+		err = ix.insert(tx, id, doc)
+		if err != nil {
+			return err
+		}
+	}
+	ids, texts, err := scanTexts(tx, fmt.Sprintf("SELECT `record_id`,COALESCE(`payload`,'') FROM `%s_code`", tb))
+	if err != nil {
+		return err
+	}
+	for k := range ids {
+		err = ix.insertCode(tx, ids[k], texts[k])
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return log.NewError("commit failed: %s", err.Error())
+	}
+	return nil
+}
+
+// scanTexts reads all (id, text) pairs a query returns before they are
+// written back in the same transaction.
+func scanTexts(tx *sql.Tx, sentence string) ([]int64, []string, error) {
+	rows, err := tx.Query(sq(sentence))
+	if err != nil {
+		return nil, nil, log.NewError("query failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var ids []int64
+	var texts []string
+	for rows.Next() {
+		var id int64
+		var text string
+		err = rows.Scan(&id, &text)
+		if err != nil {
+			return nil, nil, log.NewError("scan rows failed: %s", err.Error())
+		}
+		ids = append(ids, id)
+		texts = append(texts, text)
+	}
+	return ids, texts, rows.Err()
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSearch runs with whichever index the build has, the search table
+// without the sqlite_fts5 tag and FTS5 with it.
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t","pinyin":true}`, filepath.Join(dir, "t.db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	texts := []string{"微信支付 100元", "ＡＢＣ公司", "收据"}
+	var ids []int64
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range texts {
+		id, err := Insert(tx, &Record{Time: time.Now(), Path: "./" + text, Text: text})
+		if err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	err = InsertCode(tx, ids[2], "QR_CODE", "HTTPS://Example.com/x")
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		terms []string
+		want  []int64
+	}{
+		{[]string{"微信"}, ids[:1]},
+		{[]string{"weixin"}, ids[:1]},
+		{[]string{"weix"}, ids[:1]},
+		{[]string{"wei'xin", "支付"}, ids[:1]},
+		{[]string{"abc"}, ids[1:2]},
+		{[]string{"ABC"}, ids[1:2]},
+		{[]string{"example.com"}, ids[2:]},
+		{[]string{"微信", "公司"}, nil},
+		{[]string{"zhifubao"}, nil},
+	}
+	for _, tt := range tests {
+		records, err := Find(&Filter{Terms: tt.terms})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, r := range records {
+			got = append(got, r.ID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Find(%q) = %v, want %v", tt.terms, got, tt.want)
+		}
+	}
+}
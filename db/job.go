@@ -0,0 +1,173 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"yangsi/log"
+)
+
+const (
+	// the files found in the root dir and how far each got, so that a run
+	// goes on where the last one stopped
+	ctbJobTpl  = "CREATE TABLE IF NOT EXISTS `%[1]s_job` (`path` VARCHAR(1024) PRIMARY KEY,`size` INTEGER NOT NULL DEFAULT 0,`mod_time` INTEGER NOT NULL DEFAULT 0,`status` VARCHAR(16) NOT NULL,`attempts` INTEGER NOT NULL DEFAULT 0,`last_error` TEXT NOT NULL DEFAULT '',`ocr` TEXT NOT NULL DEFAULT '',`record_id` INTEGER NOT NULL DEFAULT 0,`updated_at` TIMESTAMP NOT NULL)"
+	cidxJobTpl = "CREATE INDEX IF NOT EXISTS `%[1]s_job_status` ON `%[1]s_job`(`status`)"
+
+	upsJobTpl  = "INSERT INTO `%[1]s_job`(%[2]s) VALUES(?,?,?,?,?,?,?,?,?,?,?) ON CONFLICT(`path`) DO UPDATE SET `size`=excluded.`size`,`mod_time`=excluded.`mod_time`,`status`=excluded.`status`,`attempts`=excluded.`attempts`,`last_error`=excluded.`last_error`,`stage`=excluded.`stage`,`class`=excluded.`class`,`ocr`=excluded.`ocr`,`record_id`=excluded.`record_id`,`updated_at`=excluded.`updated_at` WHERE `%[1]s_job`.`size`<>excluded.`size` OR `%[1]s_job`.`mod_time`<>excluded.`mod_time`"
+	jobColumns = "`path`,`size`,`mod_time`,`status`,`attempts`,`last_error`,`stage`,`class`,`ocr`,`record_id`,`updated_at`"
+)
+
+// Statuses of a job.
+const (
+	JobPending = "pending"
+	// recognized, the result kept in OCR so that it isn't asked for again
+	JobOCRDone = "ocr_done"
+	JobStored  = "stored"
+	JobFailed  = "failed"
+)
+
+// Job is a file found in the root dir. A file changed since, by its size or
+// modification time, is a new job.
+type Job struct {
+	Path     string
+	Size     int64
+	ModTime  time.Time
+	Status   string
+	Attempts int
+	// the error of the last attempt that failed, at which stage and of which
+	// class, see Failure
+	LastError string
+	Stage     string
+	Class     string
+	// what the caller needs to store the file without recognizing it again
+	OCR       string
+	RecordID  int64
+	UpdatedAt time.Time
+}
+
+func scanJob(s scanner, j *Job) error {
+	var modTime int64
+	err := s.Scan(&j.Path, &j.Size, &modTime, &j.Status, &j.Attempts, &j.LastError, &j.Stage, &j.Class, &j.OCR, &j.RecordID, &j.UpdatedAt)
+	j.ModTime = time.Unix(0, modTime)
+	j.UpdatedAt = wallClock(j.UpdatedAt)
+	return err
+}
+
+// GetJob returns the job of the file at path, nil if there is none.
+func GetJob(path string) (*Job, error) {
+	var j Job
+	err := scanJob(db.QueryRow(sq(fmt.Sprintf("SELECT %s FROM `%s_job` WHERE `path`=?", jobColumns, localConf.TBName)), path), &j)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, log.NewError("query job failed: %s, %s", path, err.Error())
+	}
+	return &j, nil
+}
+
+// Discover returns the job of the file at path, a new pending one if it
+// wasn't found before or has changed since.
+func Discover(path string, size int64, modTime time.Time) (*Job, error) {
+	j, err := GetJob(path)
+	if err != nil {
+		return nil, err
+	}
+	if j != nil && j.Size == size && j.ModTime.Equal(modTime) {
+		return j, nil
+	}
+	j = &Job{Path: path, Size: size, ModTime: modTime, Status: JobPending, UpdatedAt: time.Now()}
+	// one statement, so that a job is never missing to another process, and
+	// one that leaves it be if that process found the same file first
+	_, err = db.Exec(sq(fmt.Sprintf(upsJobTpl, localConf.TBName, jobColumns)),
+		j.Path, j.Size, j.ModTime.UnixNano(), j.Status, j.Attempts, j.LastError, j.Stage, j.Class, j.OCR, j.RecordID, formatTime(j.UpdatedAt))
+	if err != nil {
+		return nil, log.NewError("insert job failed: %s, %s", path, err.Error())
+	}
+	return GetJob(path)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func updateJob(e execer, path, set string, args ...interface{}) error {
+	args = append(append(args, formatTime(time.Now())), path)
+	_, err := e.Exec(sq(fmt.Sprintf("UPDATE `%s_job` SET %s,`updated_at`=? WHERE `path`=?", localConf.TBName, set)), args...)
+	if err != nil {
+		return log.NewError("update job failed: %s, %s", path, err.Error())
+	}
+	return nil
+}
+
+// OCRDone keeps the OCR result of the job at path.
+func OCRDone(path, ocr string) error {
+	return updateJob(db, path, "`status`=?,`ocr`=?", JobOCRDone, ocr)
+}
+
+// Stored marks the job at path stored as the row id, in the transaction
+// inserting it.
+func Stored(tx *sql.Tx, path string, id int64) error {
+	return updateJob(tx, path, "`status`=?,`ocr`='',`record_id`=?", JobStored, id)
+}
+
+// ResetJob makes the job at path pending again, as if it never failed. Its
+// OCR result is kept.
+func ResetJob(path string) error {
+	return updateJob(db, path, "`status`=?,`attempts`=0", JobPending)
+}
+
+// FailedJobs returns the failed jobs, those that failed at stage only unless
+// it is "", by path.
+func FailedJobs(stage string) ([]Job, error) {
+	sentence := fmt.Sprintf("SELECT %s FROM `%s_job` WHERE `status`=?", jobColumns, localConf.TBName)
+	args := []interface{}{JobFailed}
+	if stage != "" {
+		sentence += " AND `stage`=?"
+		args = append(args, stage)
+	}
+	rows, err := db.Query(sq(sentence+" ORDER BY `path`"), args...)
+	if err != nil {
+		return nil, log.NewError("query failed jobs failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var result []Job
+	for rows.Next() {
+		var j Job
+		err = scanJob(rows, &j)
+		if err != nil {
+			return nil, log.NewError("scan job failed: %s", err.Error())
+		}
+		result = append(result, j)
+	}
+	return result, rows.Err()
+}
+
+// DropJob forgets the job at path, once its file is gone.
+func DropJob(path string) error {
+	_, err := db.Exec(sq(fmt.Sprintf("DELETE FROM `%s_job` WHERE `path`=?", localConf.TBName)), path)
+	if err != nil {
+		return log.NewError("delete job failed: %s, %s", path, err.Error())
+	}
+	return nil
+}
+
+// JobCounts returns how many jobs have each status.
+func JobCounts() (map[string]int, error) {
+	rows, err := db.Query(sq(fmt.Sprintf("SELECT `status`,COUNT(*) FROM `%s_job` GROUP BY `status`", localConf.TBName)))
+	if err != nil {
+		return nil, log.NewError("count jobs failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var counts = make(map[string]int)
+	for rows.Next() {
+		var status string
+		var n int
+		err = rows.Scan(&status, &n)
+		if err != nil {
+			return nil, log.NewError("count jobs failed: %s", err.Error())
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// initTest opens a new SQLite database in a temp dir, removed with cleanup.
+func initTest(t *testing.T) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t"}`, filepath.Join(dir, "t.db"))))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	defer initTest(t)()
+	modTime := time.Unix(1700000000, 123)
+	j, err := Discover("./a.png", 10, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != JobPending || j.Size != 10 || !j.ModTime.Equal(modTime) {
+		t.Fatalf("new job %+v", *j)
+	}
+	err = OCRDone("./a.png", "{}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err = Discover("./a.png", 10, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != JobOCRDone || j.OCR != "{}" {
+		t.Errorf("same file: %+v, want it kept", *j)
+	}
+
+	j, err = Discover("./a.png", 11, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Status != JobPending || j.OCR != "" || j.Size != 11 {
+		t.Errorf("changed file: %+v, want a new pending job", *j)
+	}
+	counts, err := JobCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[JobPending] != 1 || len(counts) != 1 {
+		t.Errorf("counts %v, want one pending job", counts)
+	}
+}
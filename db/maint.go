@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+	"yangsi/log"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// pages copied by a backup step; writers get the database in between
+	backupPages = 256
+	backupPause = time.Millisecond * 50
+)
+
+// Backup copies the database to the new file dest with the online backup API
+// of SQLite, which gives a consistent copy while a run keeps writing. The
+// copy goes to a temporary file first, so dest is either complete or absent.
+func Backup(dest string) error {
+	if localConf.Driver != driverSQLite {
+		return log.NewError("backup is only for %s, use the tools of %s", driverSQLite, localConf.Driver)
+	}
+	_, err := os.Stat(dest)
+	if err == nil {
+		return log.NewError("backup file exists: %s", dest)
+	}
+	tmp := dest + ".tmp"
+	os.Remove(tmp)
+	err = backup(tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, dest)
+	if err != nil {
+		os.Remove(tmp)
+		return log.NewError("rename backup failed: %s", err.Error())
+	}
+	return nil
+}
+
+func backup(dest string) error {
+	ctx := context.Background()
+	destDB, err := sql.Open(driverSQLite, dest)
+	if err != nil {
+		return log.NewError("open %s failed: %s", dest, err.Error())
+	}
+	defer destDB.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return log.NewError("open %s failed: %s", dest, err.Error())
+	}
+	defer destConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return log.NewError("open %s failed: %s", localConf.DBName, err.Error())
+	}
+	defer srcConn.Close()
+
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			b, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return log.NewError("start backup failed: %s", err.Error())
+			}
+			for {
+				// a step that finds the database busy or locked is retried;
+				// one that sees it changed starts over from the first page
+				done, err := b.Step(backupPages)
+				if err != nil {
+					b.Close()
+					return log.NewError("backup failed: %s", err.Error())
+				}
+				if done {
+					break
+				}
+				log.RealtimeLog("backup: %d of %d pages left", b.Remaining(), b.PageCount())
+				time.Sleep(backupPause)
+			}
+			err = b.Close()
+			if err != nil {
+				return log.NewError("finish backup failed: %s", err.Error())
+			}
+			return nil
+		})
+	})
+}
+
+// Vacuum rebuilds the database file, giving back the space of deleted rows.
+func Vacuum() error {
+	_, err := db.Exec("VACUUM")
+	if err != nil {
+		return log.NewError("vacuum failed: %s", err.Error())
+	}
+	return nil
+}
+
+// IntegrityCheck returns the problems SQLite finds in the database file, none
+// when it is fine. PostgreSQL has no such check and returns none.
+func IntegrityCheck() ([]string, error) {
+	if localConf.Driver != driverSQLite {
+		return nil, nil
+	}
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, log.NewError("integrity check failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var msg string
+		err = rows.Scan(&msg)
+		if err != nil {
+			return nil, log.NewError("integrity check failed: %s", err.Error())
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// OrphanCodes returns the ids of codes whose row is gone.
+func OrphanCodes() ([]int64, error) {
+	rows, err := db.Query(sq(fmt.Sprintf("SELECT `id` FROM `%[1]s_code` WHERE `record_id` NOT IN (SELECT `id` FROM `%[1]s`) ORDER BY `id`", localConf.TBName)))
+	if err != nil {
+		return nil, log.NewError("query orphan codes failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, log.NewError("query orphan codes failed: %s", err.Error())
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+	"yangsi/log"
+)
+
+// The schema is changed only by appending to migrations, never by editing one
+// that has shipped: a database records in schema_version which versions it
+// has, and Init applies the missing ones in order, all in one transaction.
+// Databases from before the migrations have the tables without a
+// schema_version row; the first migrations create what they already have with
+// IF NOT EXISTS, so they are just recorded there.
+//
+// Every sentence is a template taking the table name as %[1]s, written for
+// SQLite, with its own for PostgreSQL where the types differ. The text index
+// isn't migrated, its init rebuilds it from the tables when it changes.
+type migration struct {
+	version   int
+	name      string
+	sentences []string
+	// for PostgreSQL if not the same
+	postgres []string
+}
+
+var migrations = []migration{
+	{1, "create main table", []string{ctbTpl}, []string{
+		"CREATE TABLE IF NOT EXISTS `%[1]s` (`id` BIGSERIAL PRIMARY KEY,`time` TIMESTAMP NOT NULL,`path` VARCHAR(512) NOT NULL DEFAULT '',`text` TEXT)",
+	}},
+	{2, "create code table", []string{ctbCodeTpl, cidxCodeTpl}, []string{
+		"CREATE TABLE IF NOT EXISTS `%[1]s_code` (`id` BIGSERIAL PRIMARY KEY,`record_id` BIGINT NOT NULL,`format` VARCHAR(32) NOT NULL DEFAULT '',`payload` TEXT)",
+		cidxCodeTpl,
+	}},
+	{3, "add image metadata", []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `orig_path` VARCHAR(1024) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `orig_name` VARCHAR(256) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `size` INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE `%[1]s` ADD COLUMN `width` INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE `%[1]s` ADD COLUMN `height` INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE `%[1]s` ADD COLUMN `format` VARCHAR(16) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `sha256` CHAR(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `ocr_engine` VARCHAR(32) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `ocr_endpoint` VARCHAR(256) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `ocr_ms` INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE `%[1]s` ADD COLUMN `processed_at` DATETIME",
+		"ALTER TABLE `%[1]s` ADD COLUMN `direction` INTEGER NOT NULL DEFAULT -1",
+		"CREATE INDEX IF NOT EXISTS `%[1]s_sha256` ON `%[1]s`(`sha256`)",
+	}, []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `orig_path` VARCHAR(1024) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `orig_name` VARCHAR(256) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `size` BIGINT NOT NULL DEFAULT 0",
+		"ALTER TABLE `%[1]s` ADD COLUMN `width` INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE `%[1]s` ADD COLUMN `height` INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE `%[1]s` ADD COLUMN `format` VARCHAR(16) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `sha256` CHAR(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `ocr_engine` VARCHAR(32) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `ocr_endpoint` VARCHAR(256) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `ocr_ms` INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE `%[1]s` ADD COLUMN `processed_at` TIMESTAMP",
+		"ALTER TABLE `%[1]s` ADD COLUMN `direction` INTEGER NOT NULL DEFAULT -1",
+		"CREATE INDEX IF NOT EXISTS `%[1]s_sha256` ON `%[1]s`(`sha256`)",
+	}},
+	{4, "add ocr confidence and text history", []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `confidence` REAL NOT NULL DEFAULT -1",
+		ctbHistoryTpl,
+		cidxHistoryTpl,
+	}, []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `confidence` REAL NOT NULL DEFAULT -1",
+		"CREATE TABLE IF NOT EXISTS `%[1]s_history` (`id` BIGSERIAL PRIMARY KEY,`record_id` BIGINT NOT NULL,`text` TEXT,`ocr_engine` VARCHAR(32) NOT NULL DEFAULT '',`ocr_endpoint` VARCHAR(256) NOT NULL DEFAULT '',`confidence` REAL NOT NULL DEFAULT -1,`processed_at` TIMESTAMP,`replaced_at` TIMESTAMP NOT NULL)",
+		cidxHistoryTpl,
+	}},
+	{5, "add notes, corrected text and tags", []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `note` TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `corrected_text` TEXT NOT NULL DEFAULT ''",
+		ctbTagTpl,
+		ctbRecordTagTpl,
+		cidxRecordTagTpl,
+	}, []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `note` TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `corrected_text` TEXT NOT NULL DEFAULT ''",
+		"CREATE TABLE IF NOT EXISTS `%[1]s_tag` (`id` BIGSERIAL PRIMARY KEY,`name` VARCHAR(64) NOT NULL UNIQUE)",
+		"CREATE TABLE IF NOT EXISTS `%[1]s_record_tag` (`record_id` BIGINT NOT NULL,`tag_id` BIGINT NOT NULL,PRIMARY KEY(`record_id`,`tag_id`))",
+		cidxRecordTagTpl,
+	}},
+	{6, "add camera and automatic tags", []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `camera` VARCHAR(128) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s_record_tag` ADD COLUMN `auto` INTEGER NOT NULL DEFAULT 0",
+	}, nil},
+	{7, "create entity table", []string{ctbEntityTpl, cidxEntityTpl, cidxEntityRecTpl}, []string{
+		"CREATE TABLE IF NOT EXISTS `%[1]s_entity` (`id` BIGSERIAL PRIMARY KEY,`record_id` BIGINT NOT NULL,`kind` VARCHAR(16) NOT NULL,`value` VARCHAR(256) NOT NULL,`raw` VARCHAR(256) NOT NULL DEFAULT '')",
+		cidxEntityTpl,
+		cidxEntityRecTpl,
+	}},
+	{8, "create receipt table", []string{ctbReceiptTpl}, []string{
+		"CREATE TABLE IF NOT EXISTS `%[1]s_receipt` (`record_id` BIGINT PRIMARY KEY,`kind` VARCHAR(16) NOT NULL,`merchant` VARCHAR(256) NOT NULL DEFAULT '',`date` VARCHAR(10) NOT NULL DEFAULT '',`total` VARCHAR(32) NOT NULL DEFAULT '',`tax` VARCHAR(32) NOT NULL DEFAULT '',`currency` VARCHAR(8) NOT NULL DEFAULT '',`invoice_code` VARCHAR(32) NOT NULL DEFAULT '',`invoice_number` VARCHAR(32) NOT NULL DEFAULT '',`source` VARCHAR(32) NOT NULL DEFAULT '')",
+	}},
+	{9, "add disposition of the original", []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `disposition` VARCHAR(16) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s` ADD COLUMN `disposed_path` VARCHAR(1024) NOT NULL DEFAULT ''",
+	}, nil},
+	{10, "add state of the row", []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `state` VARCHAR(16) NOT NULL DEFAULT ''",
+		"CREATE INDEX IF NOT EXISTS `%[1]s_state` ON `%[1]s`(`state`)",
+	}, nil},
+	{11, "create job table", []string{ctbJobTpl, cidxJobTpl}, []string{
+		"CREATE TABLE IF NOT EXISTS `%[1]s_job` (`path` VARCHAR(1024) PRIMARY KEY,`size` BIGINT NOT NULL DEFAULT 0,`mod_time` BIGINT NOT NULL DEFAULT 0,`status` VARCHAR(16) NOT NULL,`attempts` INTEGER NOT NULL DEFAULT 0,`last_error` TEXT NOT NULL DEFAULT '',`ocr` TEXT NOT NULL DEFAULT '',`record_id` BIGINT NOT NULL DEFAULT 0,`updated_at` TIMESTAMP NOT NULL)",
+		cidxJobTpl,
+	}},
+	{12, "add failure history", []string{
+		"ALTER TABLE `%[1]s_job` ADD COLUMN `stage` VARCHAR(16) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s_job` ADD COLUMN `class` VARCHAR(16) NOT NULL DEFAULT ''",
+		ctbFailureTpl,
+		cidxFailureTpl,
+	}, []string{
+		"ALTER TABLE `%[1]s_job` ADD COLUMN `stage` VARCHAR(16) NOT NULL DEFAULT ''",
+		"ALTER TABLE `%[1]s_job` ADD COLUMN `class` VARCHAR(16) NOT NULL DEFAULT ''",
+		"CREATE TABLE IF NOT EXISTS `%[1]s_failure` (`id` BIGSERIAL PRIMARY KEY,`path` VARCHAR(1024) NOT NULL,`stage` VARCHAR(16) NOT NULL,`class` VARCHAR(16) NOT NULL,`error` TEXT NOT NULL DEFAULT '',`quarantined` VARCHAR(1024) NOT NULL DEFAULT '',`time` TIMESTAMP NOT NULL)",
+		cidxFailureTpl,
+	}},
+	{13, "add owner of pending rows", []string{
+		"ALTER TABLE `%[1]s` ADD COLUMN `owner` VARCHAR(256) NOT NULL DEFAULT ''",
+	}, nil},
+}
+
+const (
+	ctbVersionTpl = "CREATE TABLE IF NOT EXISTS `schema_version` (`tb_name` VARCHAR(64) NOT NULL,`version` INTEGER NOT NULL,`name` VARCHAR(128) NOT NULL DEFAULT '',`time` TIMESTAMP NOT NULL,PRIMARY KEY(`tb_name`,`version`))"
+	qryVersionTpl = "SELECT COALESCE(MAX(`version`),0) FROM `schema_version` WHERE `tb_name`=?"
+	insVersionTpl = "INSERT INTO `schema_version`(`tb_name`,`version`,`name`,`time`) VALUES(?,?,?,?)"
+)
+
+// Migration describes a migration that was or would be applied.
+type Migration struct {
+	Version int
+	Name    string
+}
+
+// Migrate brings the schema of the table up to date and returns the
+// migrations it applied. With dryRun it only returns the ones it would apply.
+func Migrate(dryRun bool) ([]Migration, error) {
+	tb := localConf.TBName
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, log.NewError("begin failed: %s", err.Error())
+	}
+	defer tx.Rollback()
+	err = dia.lock(tx)
+	if err != nil {
+		return nil, log.NewError("lock schema failed: %s", err.Error())
+	}
+	_, err = tx.Exec(sq(ctbVersionTpl))
+	if err != nil {
+		return nil, log.NewError("create schema_version failed: %s", err.Error())
+	}
+	var current int
+	err = tx.QueryRow(sq(qryVersionTpl), tb).Scan(&current)
+	if err != nil {
+		return nil, log.NewError("query schema version failed: %s", err.Error())
+	}
+	if latest := migrations[len(migrations)-1].version; current > latest {
+		return nil, log.NewError("schema version %d of %s is newer than this build knows (%d)", current, tb, latest)
+	}
+	var applied []Migration
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		applied = append(applied, Migration{m.version, m.name})
+		if dryRun {
+			continue
+		}
+		err = m.apply(tx, tb)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dryRun {
+		return applied, nil
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, log.NewError("commit failed: %s", err.Error())
+	}
+	for _, m := range applied {
+		log.InfoLog("schema of %s migrated to %d: %s", tb, m.Version, m.Name)
+	}
+	return applied, nil
+}
+
+// CheckSchema fails unless the schema of the table is up to date, for the
+// commands that open the database without migrating it.
+func CheckSchema() error {
+	pending, err := Migrate(true)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return log.NewError("schema of %s is at version %d, %d migrations behind; run db migrate first",
+			localConf.TBName, pending[0].Version-1, len(pending))
+	}
+	return nil
+}
+
+func (m *migration) apply(tx *sql.Tx, tb string) error {
+	sentences := m.sentences
+	if localConf.Driver == driverPostgres && m.postgres != nil {
+		sentences = m.postgres
+	}
+	for _, tpl := range sentences {
+		_, err := tx.Exec(sq(fmt.Sprintf(tpl, tb)))
+		if err != nil {
+			return log.NewError("migration %d (%s) failed: %s", m.version, m.name, err.Error())
+		}
+	}
+	_, err := tx.Exec(sq(insVersionTpl), tb, m.version, m.name, time.Now().Format(timeLayout))
+	if err != nil {
+		return log.NewError("record migration %d failed: %s", m.version, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := []byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t"}`, filepath.Join(dir, "t.db")))
+	err = Open(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CheckSchema()
+	if err == nil || !strings.Contains(err.Error(), "run db migrate") {
+		t.Errorf("new database: %v, want to be told to migrate", err)
+	}
+	db.Close()
+
+	err = Init(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = CheckSchema()
+	if err != nil {
+		t.Errorf("migrated database: %v", err)
+	}
+}
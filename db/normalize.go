@@ -0,0 +1,182 @@
+package db
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/longbridgeapp/opencc"
+	"github.com/mozillazg/go-pinyin"
+	"golang.org/x/text/width"
+)
+
+// Text is normalized the same way when it is indexed and when it is searched:
+// full-width forms become half-width, letters lower case and traditional
+// characters simplified. Every rune maps to exactly one rune, so a match found
+// in the normalized text is at the same position in the original one.
+var (
+	t2s         *opencc.OpenCC
+	pinyinArgs  = pinyin.NewArgs()
+	syllableSet = make(map[string]bool)
+)
+
+func init() {
+	for _, s := range strings.Fields(syllables) {
+		syllableSet[s] = true
+	}
+}
+
+func normRune(r rune) rune {
+	if width.LookupRune(r).Kind() == width.EastAsianFullwidth {
+		if n := width.LookupRune(r).Narrow(); n != 0 {
+			r = n
+		}
+	}
+	return unicode.ToLower(r)
+}
+
+func normalize(s string) []rune {
+	runes := []rune(s)
+	for k := range runes {
+		runes[k] = normRune(runes[k])
+	}
+	if t2s == nil {
+		return runes
+	}
+	// the converter works on phrases; fall back to single characters when a
+	// phrase would change the length
+	out, err := t2s.Convert(string(runes))
+	if conv := []rune(out); err == nil && len(conv) == len(runes) {
+		return conv
+	}
+	for k, r := range runes {
+		if !unicode.Is(unicode.Han, r) {
+			continue
+		}
+		out, err := t2s.Convert(string(r))
+		if conv := []rune(out); err == nil && len(conv) == 1 {
+			runes[k] = conv[0]
+		}
+	}
+	return runes
+}
+
+// pinyinOf is the most common reading of a Chinese character, without tones
+// and with "v" for ü, or "" for anything else.
+func pinyinOf(r rune) string {
+	readings := pinyin.SinglePinyin(r, pinyinArgs)
+	if len(readings) == 0 {
+		return ""
+	}
+	return readings[0]
+}
+
+// pinyinText replaces every Chinese character of the normalized text with its
+// reading as a word of its own.
+func pinyinText(norm []rune) string {
+	var buf strings.Builder
+	for _, r := range norm {
+		if py := pinyinOf(r); py != "" {
+			buf.WriteString(" " + py + " ")
+		} else {
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// splitPinyin splits a term typed in pinyin into the fewest syllables, the
+// last of which may be cut short, e.g. "weix" into "wei" and "x". An
+// apostrophe may separate syllables explicitly. It returns nil for a term
+// that isn't pinyin.
+func splitPinyin(term string) []string {
+	var result []string
+	for _, part := range strings.Split(term, "'") {
+		if part == "" {
+			continue
+		}
+		for _, r := range part {
+			if r < 'a' || r > 'z' {
+				return nil
+			}
+		}
+		pieces := splitSyllables(part)
+		if pieces == nil {
+			return nil
+		}
+		result = append(result, pieces...)
+	}
+	return result
+}
+
+func splitSyllables(s string) []string {
+	// best[k] is the fewest syllables covering s[:k], from[k] where the last
+	// of them starts
+	best := make([]int, len(s)+1)
+	from := make([]int, len(s)+1)
+	for k := 1; k <= len(s); k++ {
+		best[k] = -1
+		for n := k - 1; n >= 0 && k-n <= maxSyllable; n-- {
+			if best[n] < 0 || !(syllableSet[s[n:k]] || k == len(s) && isSyllablePrefix(s[n:k])) {
+				continue
+			}
+			if best[k] < 0 || best[n]+1 < best[k] {
+				best[k] = best[n] + 1
+				from[k] = n
+			}
+		}
+	}
+	if best[len(s)] < 0 {
+		return nil
+	}
+	var pieces = make([]string, best[len(s)])
+	for k, n := len(s), len(pieces)-1; k > 0; k, n = from[k], n-1 {
+		pieces[n] = s[from[k]:k]
+	}
+	return pieces
+}
+
+func isSyllablePrefix(s string) bool {
+	for syllable := range syllableSet {
+		if strings.HasPrefix(syllable, s) {
+			return true
+		}
+	}
+	return false
+}
+
+const maxSyllable = 6
+
+// syllables of Mandarin as go-pinyin spells them without tones
+const syllables = `
+a ai an ang ao
+ba bai ban bang bao bei ben beng bi bian biao bie bin bing bo bu
+ca cai can cang cao ce cen ceng cha chai chan chang chao che chen cheng chi
+chong chou chu chua chuai chuan chuang chui chun chuo ci cong cou cu cuan cui
+cun cuo
+da dai dan dang dao de dei den deng di dia dian diao die ding diu dong dou du
+duan dui dun duo
+e ei en eng er
+fa fan fang fei fen feng fo fou fu
+ga gai gan gang gao ge gei gen geng gong gou gu gua guai guan guang gui gun guo
+ha hai han hang hao he hei hen heng hong hou hu hua huai huan huang hui hun huo
+ji jia jian jiang jiao jie jin jing jiong jiu ju juan jue jun
+ka kai kan kang kao ke kei ken keng kong kou ku kua kuai kuan kuang kui kun kuo
+la lai lan lang lao le lei leng li lia lian liang liao lie lin ling liu lo long
+lou lu luan lun luo lv lve
+ma mai man mang mao me mei men meng mi mian miao mie min ming miu mo mou mu
+na nai nan nang nao ne nei nen neng ni nian niang niao nie nin ning niu nong
+nou nu nuan nun nuo nv nve
+o ou
+pa pai pan pang pao pei pen peng pi pian piao pie pin ping po pou pu
+qi qia qian qiang qiao qie qin qing qiong qiu qu quan que qun
+ran rang rao re ren reng ri rong rou ru rua ruan rui run ruo
+sa sai san sang sao se sen seng sha shai shan shang shao she shei shen sheng shi
+shou shu shua shuai shuan shuang shui shun shuo si song sou su suan sui sun suo
+ta tai tan tang tao te teng ti tian tiao tie ting tong tou tu tuan tui tun tuo
+wa wai wan wang wei wen weng wo wu
+xi xia xian xiang xiao xie xin xing xiong xiu xu xuan xue xun
+ya yan yang yao ye yi yin ying yo yong you yu yuan yue yun
+za zai zan zang zao ze zei zen zeng zha zhai zhan zhang zhao zhe zhei zhen zheng
+zhi zhong zhou zhu zhua zhuai zhuan zhuang zhui zhun zhuo zi zong zou zu zuan
+zui zun zuo
+`
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitPinyin(t *testing.T) {
+	var tests = []struct {
+		term string
+		want []string
+	}{
+		{"weixin", []string{"wei", "xin"}},
+		{"weix", []string{"wei", "x"}},
+		{"zhongg", []string{"zhong", "g"}},
+		{"zhongguo", []string{"zhong", "guo"}},
+		// the fewest syllables, unless told otherwise
+		{"xian", []string{"xian"}},
+		{"xi'an", []string{"xi", "an"}},
+		{"'wei'", []string{"wei"}},
+		{"lvse", []string{"lv", "se"}},
+		{"zh", []string{"zh"}},
+		{"", nil},
+		{"xx", nil},
+		{"abc", nil},
+		{"wei xin", nil},
+		{"WeiXin", nil},
+		{"wei1", nil},
+	}
+	for _, tt := range tests {
+		if got := splitPinyin(tt.term); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitPinyin(%q) = %q, want %q", tt.term, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"yangsi/log"
+)
+
+const (
+	timeLayout = "2006-01-02 15:04:05"
+	// runes of context kept around the first match in a snippet
+	snippetWidth = 60
+	likeEscape   = "\\"
+)
+
+// Filter selects rows for Query and the repository functions. Every term
+// must appear in the text, the corrected text, the note, a tag or a decoded
+// code payload. From and To bound the time column inclusively unless zero;
+// Path matches a part of the archived path.
+type Filter struct {
+	Terms []string
+	From  time.Time
+	To    time.Time
+	Path  string
+	// rows with this tag
+	Tag string
+	// rows with every one of these entities
+	Entities []EntityFilter
+	// rows recognized by this OCR engine
+	Engine string
+	// rows whose text has fewer runes than this, 1 for empty text
+	ShortText int
+	// rows whose confidence is known and below this
+	LowConfidence float64
+	Limit         int
+	Offset        int
+	// Mark wraps the matches in Hit.Snippet
+	Mark [2]string
+}
+
+type Hit struct {
+	Record
+	Snippet string `json:"snippet"`
+	// score from the text index, lower is better, e.g. BM25 from FTS5
+	Rank float64 `json:"rank,omitempty"`
+}
+
+func likePattern(s string) string {
+	s = strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_").Replace(s)
+	return "%" + s + "%"
+}
+
+// from is the FROM clause where() needs, joining the text index when it
+// matches terms there.
+func (f *Filter) from() string {
+	tb := fmt.Sprintf("`%s`", localConf.TBName)
+	if len(f.Terms) > 0 {
+		return tb + index.join()
+	}
+	return tb
+}
+
+func (f *Filter) where() (string, []interface{}) {
+	tb := localConf.TBName
+	var conds []string
+	var args []interface{}
+	if len(f.Terms) > 0 {
+		cond, matchArgs := index.match(f.Terms)
+		conds = append(conds, cond)
+		args = append(args, matchArgs...)
+	}
+	if !f.From.IsZero() {
+		conds = append(conds, fmt.Sprintf("`%s`.`time` >= ?", tb))
+		args = append(args, formatTime(f.From))
+	}
+	if !f.To.IsZero() {
+		conds = append(conds, fmt.Sprintf("`%s`.`time` <= ?", tb))
+		args = append(args, formatTime(f.To))
+	}
+	if f.Path != "" {
+		conds = append(conds, fmt.Sprintf("`%s`.`path` LIKE ? ESCAPE '%s'", tb, likeEscape))
+		args = append(args, likePattern(f.Path))
+	}
+	if f.Tag != "" {
+		conds = append(conds, fmt.Sprintf("`%[1]s`.`id` IN (SELECT `%[1]s_record_tag`.`record_id` FROM `%[1]s_record_tag` JOIN `%[1]s_tag` ON `%[1]s_tag`.`id`=`%[1]s_record_tag`.`tag_id` WHERE `%[1]s_tag`.`name`=?)", tb))
+		args = append(args, f.Tag)
+	}
+	for _, e := range f.Entities {
+		cond := fmt.Sprintf("`%[1]s`.`id` IN (SELECT `record_id` FROM `%[1]s_entity` WHERE `kind`=?", tb)
+		args = append(args, e.Kind)
+		if e.Value != "" {
+			cond += fmt.Sprintf(" AND `value` LIKE ? ESCAPE '%s'", likeEscape)
+			// values starting with it
+			args = append(args, likePattern(e.Value)[1:])
+		}
+		conds = append(conds, cond+")")
+	}
+	if f.Engine != "" {
+		conds = append(conds, fmt.Sprintf("`%s`.`ocr_engine` = ?", tb))
+		args = append(args, f.Engine)
+	}
+	if f.ShortText > 0 {
+		conds = append(conds, fmt.Sprintf("LENGTH(COALESCE(`%s`.`text`,'')) < ?", tb))
+		args = append(args, f.ShortText)
+	}
+	if f.LowConfidence > 0 {
+		conds = append(conds, fmt.Sprintf("`%[1]s`.`confidence` >= 0 AND `%[1]s`.`confidence` < ?", tb))
+		args = append(args, f.LowConfidence)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// query ranks rows when the text index can, e.g. by BM25 in FTS5, otherwise
+// it orders them by time.
+func query(f *Filter) ([]Hit, error) {
+	tb := localConf.TBName
+	where, args := f.where()
+	var sentence string
+	if rank := index.rank(); rank != "" && len(f.Terms) > 0 {
+		sentence = fmt.Sprintf("SELECT %s,%s FROM %s%s ORDER BY %[2]s", columns(), rank, f.from(), where)
+	} else {
+		sentence = fmt.Sprintf("SELECT %s,0 FROM %s%s ORDER BY `%s`.`time` DESC,`%[4]s`.`id` DESC", columns(), f.from(), where, tb)
+	}
+	if f.Limit > 0 {
+		sentence += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+	rows, err := db.Query(sq(sentence), args...)
+	if err != nil {
+		return nil, log.NewError("query failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var result []Hit
+	for rows.Next() {
+		var tmp Hit
+		err = scanRecord(rows, &tmp.Record, &tmp.Rank)
+		if err != nil {
+			return nil, log.NewError("scan rows failed: %s", err.Error())
+		}
+		tmp.Snippet = snippet(tmp.Content(), f.Terms, f.Mark)
+		result = append(result, tmp)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, log.NewError("iterate rows failed: %s", err.Error())
+	}
+	return result, nil
+}
+
+// clean drops blank terms.
+func (f *Filter) clean() {
+	var terms []string
+	for _, term := range f.Terms {
+		term = strings.TrimSpace(term)
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+	f.Terms = terms
+}
+
+// Query searches the records matching f, best first when the full-text index
+// is there, and cuts a snippet of each around the matches.
+func Query(f *Filter) ([]Hit, error) {
+	f.clean()
+	return query(f)
+}
+
+func hasPrefix(s, prefix []rune) bool {
+	if len(prefix) > len(s) {
+		return false
+	}
+	for k := range prefix {
+		if s[k] != prefix[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPinyin returns how many characters from the start of norm read as
+// the syllables, the last of which may be cut short, or 0.
+func matchPinyin(norm []rune, syllables []string) int {
+	if len(syllables) > len(norm) {
+		return 0
+	}
+	for k, syllable := range syllables {
+		py := pinyinOf(norm[k])
+		if py == "" || py != syllable && (k < len(syllables)-1 || !strings.HasPrefix(py, syllable)) {
+			return 0
+		}
+	}
+	return len(syllables)
+}
+
+// snippet cuts a single line of text around the first match and wraps every
+// match inside it with mark. Matching is done on the normalized text, and on
+// the readings of its Chinese characters when pinyin is on, while the marks
+// go around the original text.
+func snippet(text string, terms []string, mark [2]string) string {
+	runes := []rune(text)
+	norm := normalize(text)
+	hit := make([]bool, len(runes))
+	first := -1
+	for _, term := range terms {
+		t := normalize(term)
+		if len(t) == 0 {
+			continue
+		}
+		var syllables []string
+		if localConf.Pinyin {
+			syllables = splitPinyin(string(t))
+		}
+		for k := range norm {
+			var n int
+			if hasPrefix(norm[k:], t) {
+				n = len(t)
+			} else if syllables != nil {
+				n = matchPinyin(norm[k:], syllables)
+			}
+			if n == 0 {
+				continue
+			}
+			for m := k; m < k+n; m++ {
+				hit[m] = true
+			}
+			if first < 0 || k < first {
+				first = k
+			}
+		}
+	}
+	if first < 0 {
+		first = 0
+	}
+	start := first - snippetWidth/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetWidth
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var buf strings.Builder
+	if start > 0 {
+		buf.WriteString("…")
+	}
+	for k := start; k < end; k++ {
+		if hit[k] && (k == start || !hit[k-1]) {
+			buf.WriteString(mark[0])
+		}
+		if runes[k] == '\n' || runes[k] == '\r' {
+			buf.WriteRune(' ')
+		} else {
+			buf.WriteRune(runes[k])
+		}
+		if hit[k] && (k == end-1 || !hit[k+1]) {
+			buf.WriteString(mark[1])
+		}
+	}
+	if end < len(runes) {
+		buf.WriteString("…")
+	}
+	return buf.String()
+}
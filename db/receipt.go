@@ -0,0 +1,91 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"yangsi/log"
+)
+
+const (
+	// the fields of the rows that are invoices or shop receipts
+	ctbReceiptTpl = "CREATE TABLE IF NOT EXISTS `%[1]s_receipt` (`record_id` INTEGER PRIMARY KEY,`kind` VARCHAR(16) NOT NULL,`merchant` VARCHAR(256) NOT NULL DEFAULT '',`date` VARCHAR(10) NOT NULL DEFAULT '',`total` VARCHAR(32) NOT NULL DEFAULT '',`tax` VARCHAR(32) NOT NULL DEFAULT '',`currency` VARCHAR(8) NOT NULL DEFAULT '',`invoice_code` VARCHAR(32) NOT NULL DEFAULT '',`invoice_number` VARCHAR(32) NOT NULL DEFAULT '',`source` VARCHAR(32) NOT NULL DEFAULT '')"
+
+	receiptColumns = "`record_id`,`kind`,`merchant`,`date`,`total`,`tax`,`currency`,`invoice_code`,`invoice_number`,`source`"
+)
+
+// Kinds of receipts.
+const (
+	Invoice     = "invoice"
+	ShopReceipt = "receipt"
+)
+
+// Receipt is what was read from an invoice or a shop receipt. Amounts are
+// decimals as "1234.50", dates as "2006-01-02", and "" when not found.
+type Receipt struct {
+	RecordID      int64  `json:"record_id"`
+	Kind          string `json:"kind"`
+	Merchant      string `json:"merchant"`
+	Date          string `json:"date"`
+	Total         string `json:"total"`
+	Tax           string `json:"tax"`
+	Currency      string `json:"currency"`
+	InvoiceCode   string `json:"invoice_code"`
+	InvoiceNumber string `json:"invoice_number"`
+	// "text" when parsed from the text, else the API that read it
+	Source string `json:"source"`
+	// of the row, for reports
+	Path string `json:"path,omitempty"`
+}
+
+// SetReceipt replaces the receipt of the row id, nil meaning it has none.
+func SetReceipt(tx *sql.Tx, id int64, r *Receipt) error {
+	tb := localConf.TBName
+	_, err := tx.Exec(sq(fmt.Sprintf("DELETE FROM `%s_receipt` WHERE `record_id`=?", tb)), id)
+	if err != nil {
+		return log.NewError("delete receipt failed: %d, %s", id, err.Error())
+	}
+	if r == nil {
+		return nil
+	}
+	r.RecordID = id
+	_, err = tx.Exec(sq(fmt.Sprintf("INSERT INTO `%s_receipt`(%s) VALUES(?,?,?,?,?,?,?,?,?,?)", tb, receiptColumns)),
+		id, r.Kind, r.Merchant, r.Date, r.Total, r.Tax, r.Currency, r.InvoiceCode, r.InvoiceNumber, r.Source)
+	if err != nil {
+		return log.NewError("insert receipt failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+// Receipts returns the receipts of the rows matching f, by date.
+func Receipts(f *Filter) ([]Receipt, error) {
+	tb := localConf.TBName
+	f.clean()
+	where, args := f.where()
+	var cols []string
+	for _, c := range strings.Split(receiptColumns, ",") {
+		cols = append(cols, fmt.Sprintf("`%s_receipt`.%s", tb, c))
+	}
+	sentence := fmt.Sprintf("SELECT %[1]s,`%[2]s`.`path` FROM %[3]s JOIN `%[2]s_receipt` ON `%[2]s_receipt`.`record_id`=`%[2]s`.`id`%[4]s ORDER BY `%[2]s_receipt`.`date`,`%[2]s`.`id`",
+		strings.Join(cols, ","), tb, f.from(), where)
+	if f.Limit > 0 {
+		sentence += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+	rows, err := db.Query(sq(sentence), args...)
+	if err != nil {
+		return nil, log.NewError("query receipts failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var result []Receipt
+	for rows.Next() {
+		var r Receipt
+		err = rows.Scan(&r.RecordID, &r.Kind, &r.Merchant, &r.Date, &r.Total, &r.Tax, &r.Currency,
+			&r.InvoiceCode, &r.InvoiceNumber, &r.Source, &r.Path)
+		if err != nil {
+			return nil, log.NewError("scan receipts failed: %s", err.Error())
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,248 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"yangsi/log"
+)
+
+// Record is a row of the main table. Time is the modification time of the
+// original file and Path where its copy is archived; the Orig fields, Size,
+// Width, Height, Format and SHA256 describe the original.
+//
+// Times are stored as local wall-clock time in the "2006-01-02 15:04:05"
+// layout, which keeps them comparable as strings, and read back in
+// time.Local. ProcessedAt is zero for rows from before it was recorded.
+type Record struct {
+	ID          int64     `json:"id"`
+	Time        time.Time `json:"time"`
+	Path        string    `json:"path"`
+	Text        string    `json:"text"`
+	OrigPath    string    `json:"orig_path"`
+	OrigName    string    `json:"orig_name"`
+	Size        int64     `json:"size"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Format      string    `json:"format"`
+	SHA256      string    `json:"sha256"`
+	OCREngine   string    `json:"ocr_engine"`
+	OCREndpoint string    `json:"ocr_endpoint"`
+	OCRMillis   int64     `json:"ocr_ms"`
+	ProcessedAt time.Time `json:"processed_at"`
+	// see baiduocr.Result
+	Direction int `json:"direction"`
+	// mean probability of the recognized lines, -1 for rows from before it
+	// was recorded
+	Confidence float64 `json:"confidence"`
+	// written by hand: a free-form note, and the text as it should have been
+	// recognized, "" when Text is right
+	Note          string `json:"note"`
+	CorrectedText string `json:"corrected_text"`
+	// make and model of the camera from the EXIF of the original
+	Camera string `json:"camera"`
+	// what was done with the original, see package dispose, "" for rows from
+	// before it was recorded; and where it went when moved or trashed
+	Disposition  string `json:"disposition"`
+	DisposedPath string `json:"disposed_path"`
+	// Pending until the archived copy has its name and the original was
+	// disposed of
+	State string `json:"state,omitempty"`
+}
+
+// Content is the text of r, corrected if it was.
+func (r *Record) Content() string {
+	if r.CorrectedText != "" {
+		return r.CorrectedText
+	}
+	return r.Text
+}
+
+var ErrNotFound = errors.New("record not found")
+
+// recordColumns are the columns scanRecord reads, in its order.
+var recordColumns = []string{"id", "time", "path", "text", "orig_path", "orig_name", "size",
+	"width", "height", "format", "sha256", "ocr_engine", "ocr_endpoint", "ocr_ms",
+	"processed_at", "direction", "confidence", "note", "corrected_text", "camera",
+	"disposition", "disposed_path", "state"}
+
+// columns lists recordColumns qualified with the main table, as the
+// full-text index has a text column too.
+func columns() string {
+	var cols = make([]string, len(recordColumns))
+	for k, col := range recordColumns {
+		cols[k] = fmt.Sprintf("`%s`.`%s`", localConf.TBName, col)
+	}
+	return strings.Join(cols, ",")
+}
+
+func formatTime(t time.Time) string {
+	return t.In(time.Local).Format(timeLayout)
+}
+
+// wallClock puts a time the driver read as UTC back in time.Local.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.Local)
+}
+
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return formatTime(t)
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRecord reads recordColumns and then extra into r.
+func scanRecord(row scanner, r *Record, extra ...interface{}) error {
+	var processedAt sql.NullTime
+	var text sql.NullString
+	dest := []interface{}{&r.ID, &r.Time, &r.Path, &text, &r.OrigPath, &r.OrigName, &r.Size,
+		&r.Width, &r.Height, &r.Format, &r.SHA256, &r.OCREngine, &r.OCREndpoint, &r.OCRMillis,
+		&processedAt, &r.Direction, &r.Confidence, &r.Note, &r.CorrectedText, &r.Camera,
+		&r.Disposition, &r.DisposedPath, &r.State}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return err
+	}
+	r.Time = wallClock(r.Time)
+	r.Text = text.String
+	r.ProcessedAt = time.Time{}
+	if processedAt.Valid {
+		r.ProcessedAt = wallClock(processedAt.Time)
+	}
+	return nil
+}
+
+func Get(id int64) (*Record, error) {
+	var r Record
+	err := scanRecord(db.QueryRow(sq(fmt.Sprintf("SELECT %s FROM `%s` WHERE `id`=?", columns(), localConf.TBName)), id), &r)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, log.NewError("get record failed: %d, %s", id, err.Error())
+	}
+	return &r, nil
+}
+
+// Find returns the records matching f, newest first.
+func Find(f *Filter) ([]Record, error) {
+	var result []Record
+	err := Each(context.Background(), f, func(r *Record) error {
+		result = append(result, *r)
+		return nil
+	})
+	return result, err
+}
+
+// Each calls fn with every record matching f, newest first, until fn returns
+// an error or ctx is done. The record is reused between calls.
+func Each(ctx context.Context, f *Filter, fn func(r *Record) error) error {
+	f.clean()
+	where, args := f.where()
+	sentence := fmt.Sprintf("SELECT %s FROM %s%s ORDER BY `%s`.`time` DESC,`%[4]s`.`id` DESC", columns(), f.from(), where, localConf.TBName)
+	if f.Limit > 0 {
+		sentence += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+	rows, err := db.QueryContext(ctx, sq(sentence), args...)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return log.NewError("query failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var r Record
+	for rows.Next() {
+		err = scanRecord(rows, &r)
+		if err != nil {
+			return log.NewError("scan rows failed: %s", err.Error())
+		}
+		err = fn(&r)
+		if err != nil {
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return log.NewError("iterate rows failed: %s", err.Error())
+	}
+	return ctx.Err()
+}
+
+// Count returns how many records match f, ignoring its Limit and Offset.
+func Count(f *Filter) (int64, error) {
+	f.clean()
+	where, args := f.where()
+	var count int64
+	err := db.QueryRow(sq(fmt.Sprintf("SELECT COUNT(*) FROM %s%s", f.from(), where)), args...).Scan(&count)
+	if err != nil {
+		return 0, log.NewError("count failed: %s", err.Error())
+	}
+	return count, nil
+}
+
+// Update writes every column of r to the row r.ID and reindexes it.
+func Update(tx *sql.Tx, r *Record) error {
+	res, err := tx.Exec(updateSentence, formatTime(r.Time), r.Path, r.Text, r.OrigPath, r.OrigName,
+		r.Size, r.Width, r.Height, r.Format, r.SHA256, r.OCREngine, r.OCREndpoint, r.OCRMillis,
+		nullTime(r.ProcessedAt), r.Direction, r.Confidence, r.Note, r.CorrectedText, r.Camera,
+		r.Disposition, r.DisposedPath, r.State, r.ID)
+	if err != nil {
+		return log.NewError("update failed: %d, %s", r.ID, err.Error())
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.NewError("update failed: %d, %s", r.ID, err.Error())
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return reindex(tx, r.ID)
+}
+
+// Delete removes the row id with its codes, tags, entities, receipt and
+// index entry. The archived image is left alone.
+func Delete(tx *sql.Tx, id int64) error {
+	res, err := tx.Exec(sq(fmt.Sprintf("DELETE FROM `%s` WHERE `id`=?", localConf.TBName)), id)
+	if err != nil {
+		return log.NewError("delete failed: %d, %s", id, err.Error())
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return log.NewError("delete failed: %d, %s", id, err.Error())
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	_, err = tx.Exec(sq(fmt.Sprintf("DELETE FROM `%s_code` WHERE `record_id`=?", localConf.TBName)), id)
+	if err != nil {
+		return log.NewError("delete codes failed: %d, %s", id, err.Error())
+	}
+	_, err = tx.Exec(sq(fmt.Sprintf("DELETE FROM `%s_record_tag` WHERE `record_id`=?", localConf.TBName)), id)
+	if err != nil {
+		return log.NewError("delete tags failed: %d, %s", id, err.Error())
+	}
+	err = SetEntities(tx, id, nil)
+	if err != nil {
+		return err
+	}
+	err = SetReceipt(tx, id, nil)
+	if err != nil {
+		return err
+	}
+	// for its file to be found again
+	_, err = tx.Exec(sq(fmt.Sprintf("DELETE FROM `%s_job` WHERE `record_id`=?", localConf.TBName)), id)
+	if err != nil {
+		return log.NewError("delete job failed: %d, %s", id, err.Error())
+	}
+	return index.delete(tx, id)
+}
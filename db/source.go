@@ -0,0 +1,258 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"yangsi/log"
+)
+
+// Code is a QR code or barcode payload stored with a row.
+type Code struct {
+	Format  string `json:"format"`
+	Payload string `json:"payload"`
+}
+
+// Source is another SQLite database of yangsi, opened read-only to import
+// its rows. It may be of any older schema: columns it doesn't have yet read
+// as their defaults, tables it doesn't have as nothing.
+type Source struct {
+	db              *sql.DB
+	sentence        string
+	codeSentence    string
+	tagSentence     string
+	receiptSentence string
+	historySentence string
+}
+
+// SourceRow is a row of a Source with what hangs off it.
+type SourceRow struct {
+	Record
+	Codes []Code
+	// tags put by hand, and those rules put
+	Tags     []string
+	AutoTags []string
+	// nil unless it is an invoice or a receipt
+	Receipt *Receipt
+	History []Version
+}
+
+// defaults of the columns added after the first schema
+var columnDefaults = map[string]string{
+	"orig_path": "''", "orig_name": "''", "size": "0", "width": "0", "height": "0",
+	"format": "''", "sha256": "''", "ocr_engine": "''", "ocr_endpoint": "''", "ocr_ms": "0",
+	"processed_at": "NULL", "direction": "-1", "confidence": "-1",
+	"note": "''", "corrected_text": "''", "camera": "''",
+	"disposition": "''", "disposed_path": "''", "state": "''",
+}
+
+// OpenSource opens the database at path read-only.
+func OpenSource(path, tb string) (*Source, error) {
+	// escaped, as a ? or # would end the path of the URI
+	src, err := sql.Open(driverSQLite, fmt.Sprintf("file:%s?mode=ro", url.PathEscape(path)))
+	if err != nil {
+		return nil, log.NewError("open %s failed: %s", path, err.Error())
+	}
+	s := &Source{db: src}
+	err = s.prepare(path, tb)
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Source) prepare(path, tb string) error {
+	have, err := s.columns(tb)
+	if err != nil {
+		return err
+	}
+	if !have["id"] {
+		return log.NewError("no table %s in %s", tb, path)
+	}
+	var cols = make([]string, len(recordColumns))
+	for k, col := range recordColumns {
+		cols[k] = fmt.Sprintf("`%s`", col)
+		if !have[col] {
+			cols[k] = columnDefaults[col]
+		}
+	}
+	s.sentence = fmt.Sprintf("SELECT %s FROM `%s`", strings.Join(cols, ","), tb)
+	if have["state"] {
+		// pending rows may not have their archived copy under its name yet
+		s.sentence += " WHERE `state`=''"
+	}
+	s.sentence += " ORDER BY `id`"
+	codes, err := s.columns(tb + "_code")
+	if err != nil {
+		return err
+	}
+	if codes["record_id"] {
+		s.codeSentence = fmt.Sprintf("SELECT `format`,COALESCE(`payload`,'') FROM `%s_code` WHERE `record_id`=? ORDER BY `id`", tb)
+	}
+	tags, err := s.columns(tb + "_record_tag")
+	if err != nil {
+		return err
+	}
+	if tags["record_id"] {
+		auto := "0"
+		if tags["auto"] {
+			auto = "`%[1]s_record_tag`.`auto`"
+		}
+		s.tagSentence = fmt.Sprintf("SELECT `%[1]s_tag`.`name`,"+auto+" FROM `%[1]s_tag` JOIN `%[1]s_record_tag` ON `%[1]s_record_tag`.`tag_id`=`%[1]s_tag`.`id` WHERE `%[1]s_record_tag`.`record_id`=? ORDER BY `%[1]s_tag`.`name`", tb)
+	}
+	receipts, err := s.columns(tb + "_receipt")
+	if err != nil {
+		return err
+	}
+	if receipts["record_id"] {
+		s.receiptSentence = fmt.Sprintf("SELECT %s FROM `%s_receipt` WHERE `record_id`=?", receiptColumns, tb)
+	}
+	history, err := s.columns(tb + "_history")
+	if err != nil {
+		return err
+	}
+	if history["record_id"] {
+		s.historySentence = fmt.Sprintf(qryHistoryTpl, tb)
+	}
+	return nil
+}
+
+func (s *Source) columns(tb string) (map[string]bool, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT `name` FROM pragma_table_info('%s')", strings.Replace(tb, "'", "''", -1)))
+	if err != nil {
+		return nil, log.NewError("read columns of %s failed: %s", tb, err.Error())
+	}
+	defer rows.Close()
+	var have = make(map[string]bool)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, log.NewError("read columns of %s failed: %s", tb, err.Error())
+		}
+		have[name] = true
+	}
+	return have, rows.Err()
+}
+
+func (s *Source) Close() error {
+	return s.db.Close()
+}
+
+// Each calls fn with every row that is done, with what hangs off it, in the
+// order they were written, until fn returns an error or ctx is done.
+func (s *Source) Each(ctx context.Context, fn func(r *SourceRow) error) error {
+	rows, err := s.db.QueryContext(ctx, s.sentence)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return log.NewError("query source failed: %s", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r SourceRow
+		err = scanRecord(rows, &r.Record)
+		if err != nil {
+			return log.NewError("scan source failed: %s", err.Error())
+		}
+		err = s.extras(ctx, &r)
+		if err != nil {
+			return err
+		}
+		err = fn(&r)
+		if err != nil {
+			return err
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return log.NewError("iterate source failed: %s", err.Error())
+	}
+	return ctx.Err()
+}
+
+// extras reads what hangs off r.
+func (s *Source) extras(ctx context.Context, r *SourceRow) error {
+	err := s.each(ctx, "codes", s.codeSentence, r.ID, func(rows *sql.Rows) error {
+		var c Code
+		err := rows.Scan(&c.Format, &c.Payload)
+		r.Codes = append(r.Codes, c)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = s.each(ctx, "tags", s.tagSentence, r.ID, func(rows *sql.Rows) error {
+		var name string
+		var auto int
+		err := rows.Scan(&name, &auto)
+		if auto == 1 {
+			r.AutoTags = append(r.AutoTags, name)
+		} else {
+			r.Tags = append(r.Tags, name)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = s.each(ctx, "receipt", s.receiptSentence, r.ID, func(rows *sql.Rows) error {
+		r.Receipt = new(Receipt)
+		return rows.Scan(&r.Receipt.RecordID, &r.Receipt.Kind, &r.Receipt.Merchant, &r.Receipt.Date, &r.Receipt.Total,
+			&r.Receipt.Tax, &r.Receipt.Currency, &r.Receipt.InvoiceCode, &r.Receipt.InvoiceNumber, &r.Receipt.Source)
+	})
+	if err != nil {
+		return err
+	}
+	return s.each(ctx, "history", s.historySentence, r.ID, func(rows *sql.Rows) error {
+		var v Version
+		err := scanVersion(rows, &v)
+		r.History = append(r.History, v)
+		return err
+	})
+}
+
+// each calls scan with every row sentence returns for the row id, none when
+// the source has no table for what.
+func (s *Source) each(ctx context.Context, what, sentence string, id int64, scan func(rows *sql.Rows) error) error {
+	if sentence == "" {
+		return nil
+	}
+	rows, err := s.db.QueryContext(ctx, sentence, id)
+	if err != nil {
+		return log.NewError("query source %s failed: %s", what, err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			return log.NewError("scan source %s failed: %s", what, err.Error())
+		}
+	}
+	return rows.Err()
+}
+
+// Kept tells whether the original at path with this hash was stored and kept
+// in place, and so is not to be stored again.
+func Kept(path, sha string) (bool, error) {
+	var n int64
+	err := db.QueryRow(sq(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE `sha256`=? AND `orig_path`=? AND `disposition`='keep'", localConf.TBName)), sha, path).Scan(&n)
+	if err != nil {
+		return false, log.NewError("query kept failed: %s", err.Error())
+	}
+	return n > 0, nil
+}
+
+// HasSHA256 tells whether a row of an original with this hash exists.
+func HasSHA256(sha string) (bool, error) {
+	var n int64
+	err := db.QueryRow(sq(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE `sha256`=?", localConf.TBName)), sha).Scan(&n)
+	if err != nil {
+		return false, log.NewError("query sha256 failed: %s", err.Error())
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func inTestTx(t *testing.T, fn func(tx *sql.Tx) error) {
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "other.db")
+	err = Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t"}`, path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 1, 8, 0, 0, 0, time.Local)
+	done := &Record{Time: at, Path: "./out/20261001/a_o.jpg", Text: "old", ProcessedAt: at}
+	pending := &Record{Time: at, Path: "./out/20261001/b_o.jpg", Text: "b", State: Pending}
+	receipt := &Receipt{Kind: ShopReceipt, Merchant: "全家", Date: "2026-10-01", Total: "12.50", Currency: "CNY", Source: "text"}
+	inTestTx(t, func(tx *sql.Tx) error {
+		for _, r := range []*Record{done, pending} {
+			if _, err := Insert(tx, r); err != nil {
+				return err
+			}
+		}
+		if err := InsertCode(tx, done.ID, "QR_CODE", "https://example.com"); err != nil {
+			return err
+		}
+		if err := AddTags(tx, done.ID, "mine"); err != nil {
+			return err
+		}
+		if err := SetAutoTags(tx, done.ID, "shop"); err != nil {
+			return err
+		}
+		return SetReceipt(tx, done.ID, receipt)
+	})
+	inTestTx(t, func(tx *sql.Tx) error {
+		r := *done
+		r.Text = "new"
+		return Revise(tx, &r)
+	})
+	db.Close()
+	// a ?, a # or a % would break the URI unless escaped
+	other := filepath.Join(dir, "other?#1 100%.db")
+	err = os.Rename(path, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src, err := OpenSource(other, "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	var rows []SourceRow
+	err = src.Each(context.Background(), func(r *SourceRow) error {
+		rows = append(rows, *r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].ID != done.ID {
+		t.Fatalf("%d rows, want the done one only", len(rows))
+	}
+	r := rows[0]
+	if r.Text != "new" {
+		t.Errorf("text %q, want %q", r.Text, "new")
+	}
+	if want := []Code{{"QR_CODE", "https://example.com"}}; !reflect.DeepEqual(r.Codes, want) {
+		t.Errorf("codes %v, want %v", r.Codes, want)
+	}
+	if !reflect.DeepEqual(r.Tags, []string{"mine"}) || !reflect.DeepEqual(r.AutoTags, []string{"shop"}) {
+		t.Errorf("tags %v, auto tags %v, want [mine] and [shop]", r.Tags, r.AutoTags)
+	}
+	if r.Receipt == nil || *r.Receipt != *receipt {
+		t.Errorf("receipt %+v, want %+v", r.Receipt, receipt)
+	}
+	if len(r.History) != 1 || r.History[0].Text != "old" || !r.History[0].ProcessedAt.Equal(at) {
+		t.Errorf("history %+v, want the old text", r.History)
+	}
+}
@@ -0,0 +1,70 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"yangsi/log"
+)
+
+// States of a row. A row is committed pending, before its archived copy is
+// renamed from the temporary name it was written to and its original is
+// disposed of, and done after; run finishes the rows a crash left pending.
+const (
+	Done    = ""
+	Pending = "pending"
+)
+
+// Owner names this process on the rows it commits pending, host:pid, so
+// that processes sharing a database finish only their own.
+var Owner = owner()
+
+func owner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", host, os.Getpid())
+}
+
+// Claim marks the pending row id as this process's, in the transaction
+// inserting it.
+func Claim(tx *sql.Tx, id int64) error {
+	_, err := tx.Exec(sq(fmt.Sprintf("UPDATE `%s` SET `owner`=? WHERE `id`=?", localConf.TBName)), Owner, id)
+	if err != nil {
+		return log.NewError("claim failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
+
+// PendingRecord is a row left pending by Owner, "" when it was left before
+// owners were recorded.
+type PendingRecord struct {
+	Record
+	Owner string
+}
+
+// PendingRecords returns the rows left pending, oldest first.
+func PendingRecords() ([]PendingRecord, error) {
+	rows, err := db.Query(sq(fmt.Sprintf("SELECT %s,`owner` FROM `%s` WHERE `state`=? ORDER BY `id`", columns(), localConf.TBName)), Pending)
+	if err != nil {
+		return nil, log.NewError("query pending failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var result []PendingRecord
+	for rows.Next() {
+		var r PendingRecord
+		err = scanRecord(rows, &r.Record, &r.Owner)
+		if err != nil {
+			return nil, log.NewError("scan pending failed: %s", err.Error())
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// SetState sets the state of the row id.
+func SetState(id int64, state string) error {
+	_, err := db.Exec(sq(fmt.Sprintf("UPDATE `%s` SET `state`=? WHERE `id`=?", localConf.TBName)), state, id)
+	if err != nil {
+		return log.NewError("set state failed: %d, %s", id, err.Error())
+	}
+	return nil
+}
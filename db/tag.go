@@ -0,0 +1,230 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"yangsi/log"
+)
+
+const (
+	// tags are shared by name between the rows of the main table
+	ctbTagTpl        = "CREATE TABLE IF NOT EXISTS `%[1]s_tag` (`id` INTEGER PRIMARY KEY,`name` VARCHAR(64) NOT NULL UNIQUE)"
+	ctbRecordTagTpl  = "CREATE TABLE IF NOT EXISTS `%[1]s_record_tag` (`record_id` INTEGER NOT NULL,`tag_id` INTEGER NOT NULL,PRIMARY KEY(`record_id`,`tag_id`))"
+	cidxRecordTagTpl = "CREATE INDEX IF NOT EXISTS `%[1]s_record_tag_tag` ON `%[1]s_record_tag`(`tag_id`)"
+
+	qryRecordTagsTpl = "SELECT `%[1]s_tag`.`name` FROM `%[1]s_tag` JOIN `%[1]s_record_tag` ON `%[1]s_record_tag`.`tag_id`=`%[1]s_tag`.`id` WHERE `%[1]s_record_tag`.`record_id`=? ORDER BY `%[1]s_tag`.`name`"
+)
+
+// TagCount is a tag and how many rows have it.
+type TagCount struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+}
+
+// document is what the text index holds for a row: its text with what was
+// written by hand about it.
+func document(text, corrected, note string, tags []string) string {
+	parts := []string{text}
+	for _, s := range append([]string{corrected, note}, tags...) {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// rowDocument reads the document of the row id within tx.
+func rowDocument(tx *sql.Tx, id int64) (string, error) {
+	var text sql.NullString
+	var corrected, note string
+	err := tx.QueryRow(sq(fmt.Sprintf("SELECT `text`,`corrected_text`,`note` FROM `%s` WHERE `id`=?", localConf.TBName)), id).Scan(&text, &corrected, &note)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", log.NewError("read row failed: %d, %s", id, err.Error())
+	}
+	tags, err := queryTags(tx, id)
+	if err != nil {
+		return "", err
+	}
+	return document(text.String, corrected, note, tags), nil
+}
+
+// reindex writes the document of the row id to the text index again.
+func reindex(tx *sql.Tx, id int64) error {
+	doc, err := rowDocument(tx, id)
+	if err != nil {
+		return err
+	}
+	return index.update(tx, id, doc)
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func queryTags(q querier, id int64) ([]string, error) {
+	rows, err := q.Query(sq(fmt.Sprintf(qryRecordTagsTpl, localConf.TBName)), id)
+	if err != nil {
+		return nil, log.NewError("query tags failed: %d, %s", id, err.Error())
+	}
+	defer rows.Close()
+	var tags []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, log.NewError("scan tags failed: %d, %s", id, err.Error())
+		}
+		tags = append(tags, name)
+	}
+	return tags, rows.Err()
+}
+
+// Tags returns the tags of the row id by name.
+func Tags(id int64) ([]string, error) {
+	return queryTags(db, id)
+}
+
+// TagCounts returns every tag in use by name.
+func TagCounts() ([]TagCount, error) {
+	rows, err := db.Query(sq(fmt.Sprintf("SELECT `%[1]s_tag`.`name`,COUNT(*) FROM `%[1]s_tag` JOIN `%[1]s_record_tag` ON `%[1]s_record_tag`.`tag_id`=`%[1]s_tag`.`id` GROUP BY `%[1]s_tag`.`name` ORDER BY `%[1]s_tag`.`name`", localConf.TBName)))
+	if err != nil {
+		return nil, log.NewError("query tags failed: %s", err.Error())
+	}
+	defer rows.Close()
+	var result []TagCount
+	for rows.Next() {
+		var tc TagCount
+		err = rows.Scan(&tc.Name, &tc.Count)
+		if err != nil {
+			return nil, log.NewError("scan tags failed: %s", err.Error())
+		}
+		result = append(result, tc)
+	}
+	return result, rows.Err()
+}
+
+func tagID(tx *sql.Tx, name string) (int64, error) {
+	tb := localConf.TBName
+	var id int64
+	err := tx.QueryRow(sq(fmt.Sprintf("SELECT `id` FROM `%s_tag` WHERE `name`=?", tb)), name).Scan(&id)
+	if err == sql.ErrNoRows {
+		id, err = dia.insert(tx, sq(fmt.Sprintf("INSERT INTO `%s_tag`(`name`) VALUES(?)", tb)), name)
+	}
+	if err != nil {
+		return 0, log.NewError("add tag failed: %s, %s", name, err.Error())
+	}
+	return id, nil
+}
+
+func recordExists(tx *sql.Tx, id int64) error {
+	var n int64
+	err := tx.QueryRow(sq(fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE `id`=?", localConf.TBName)), id).Scan(&n)
+	if err != nil {
+		return log.NewError("read row failed: %d, %s", id, err.Error())
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// tag puts the tag name on the row id unless it has it. A tag put by hand
+// stays one, even when a rule would put it too.
+func tag(tx *sql.Tx, id int64, name string, auto bool) error {
+	tb := localConf.TBName
+	tid, err := tagID(tx, name)
+	if err != nil {
+		return err
+	}
+	var current int
+	err = tx.QueryRow(sq(fmt.Sprintf("SELECT `auto` FROM `%s_record_tag` WHERE `record_id`=? AND `tag_id`=?", tb)), id, tid).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		_, err = tx.Exec(sq(fmt.Sprintf("INSERT INTO `%s_record_tag`(`record_id`,`tag_id`,`auto`) VALUES(?,?,?)", tb)), id, tid, boolInt(auto))
+	case err == nil && current == 1 && !auto:
+		_, err = tx.Exec(sq(fmt.Sprintf("UPDATE `%s_record_tag` SET `auto`=0 WHERE `record_id`=? AND `tag_id`=?", tb)), id, tid)
+	}
+	if err != nil {
+		return log.NewError("tag failed: %d, %s, %s", id, name, err.Error())
+	}
+	return nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// AddTags tags the row id by hand, creating the tags it doesn't know yet.
+func AddTags(tx *sql.Tx, id int64, names ...string) error {
+	err := recordExists(tx, id)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		err = tag(tx, id, name, false)
+		if err != nil {
+			return err
+		}
+	}
+	return reindex(tx, id)
+}
+
+// SetAutoTags replaces the tags rules put on the row id with names. Tags put
+// by hand are kept.
+func SetAutoTags(tx *sql.Tx, id int64, names ...string) error {
+	err := recordExists(tx, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sq(fmt.Sprintf("DELETE FROM `%s_record_tag` WHERE `record_id`=? AND `auto`=1", localConf.TBName)), id)
+	if err != nil {
+		return log.NewError("untag failed: %d, %s", id, err.Error())
+	}
+	for _, name := range names {
+		err = tag(tx, id, name, true)
+		if err != nil {
+			return err
+		}
+	}
+	err = cleanTags(tx)
+	if err != nil {
+		return err
+	}
+	return reindex(tx, id)
+}
+
+// RemoveTags takes tags off the row id and forgets tags no row has anymore.
+func RemoveTags(tx *sql.Tx, id int64, names ...string) error {
+	tb := localConf.TBName
+	for _, name := range names {
+		_, err := tx.Exec(sq(fmt.Sprintf("DELETE FROM `%[1]s_record_tag` WHERE `record_id`=? AND `tag_id` IN (SELECT `id` FROM `%[1]s_tag` WHERE `name`=?)", tb)), id, strings.TrimSpace(name))
+		if err != nil {
+			return log.NewError("untag failed: %d, %s, %s", id, name, err.Error())
+		}
+	}
+	err := cleanTags(tx)
+	if err != nil {
+		return err
+	}
+	return reindex(tx, id)
+}
+
+// cleanTags forgets the tags no row has anymore.
+func cleanTags(tx *sql.Tx) error {
+	_, err := tx.Exec(sq(fmt.Sprintf("DELETE FROM `%[1]s_tag` WHERE `id` NOT IN (SELECT `tag_id` FROM `%[1]s_record_tag`)", localConf.TBName)))
+	if err != nil {
+		return log.NewError("clean tags failed: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"fmt"
+	"yangsi/log"
+)
+
+// PostgreSQL has no tokenizer for Chinese, so rather than its full-text
+// search the text index there is the search table (see index.go) with pg_trgm
+// indexes, which speed up the LIKE '%term%' a term becomes. Creating the
+// extension takes a privileged user once; without it matching still works,
+// only by scanning.
+const trgmCidxTpl = "CREATE INDEX IF NOT EXISTS `%[1]s_search_%[2]s` ON `%[1]s_search` USING GIN (`%[2]s` gin_trgm_ops)"
+
+// trgmIndex is the search table with pg_trgm indexes.
+type trgmIndex struct {
+	searchIndex
+}
+
+func (ix *trgmIndex) init() (textIndex, error) {
+	_, err := ix.searchIndex.init()
+	if err != nil {
+		return nil, err
+	}
+	err = createTrgm()
+	if err != nil {
+		log.WarnLog("pg_trgm indexes not created, search scans the table: %s", err.Error())
+	}
+	return ix, nil
+}
+
+func createTrgm() error {
+	_, err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm")
+	if err != nil {
+		return err
+	}
+	for _, col := range []string{"text", "codes", "pinyin"} {
+		_, err = db.Exec(sq(fmt.Sprintf(trgmCidxTpl, localConf.TBName, col)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
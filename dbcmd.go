@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"yangsi/db"
+	"yangsi/img"
+	"yangsi/log"
+)
+
+var dbCommands = map[string]func(args []string) error{
+	"migrate": migrate,
+	"backup":  backup,
+	"vacuum":  vacuum,
+	"check":   check,
+}
+
+func dbCommand(args []string) error {
+	if len(args) == 0 || dbCommands[args[0]] == nil {
+		return log.NewError("unknown db command: %v, want migrate, backup, vacuum or check", args)
+	}
+	return dbCommands[args[0]](args[1:])
+}
+
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("db migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only list the migrations that would be applied")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	applied, err := db.Migrate(*dryRun)
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Println("schema is up to date")
+		return nil
+	}
+	for _, m := range applied {
+		if *dryRun {
+			fmt.Printf("pending\t%d\t%s\n", m.Version, m.Name)
+		} else {
+			fmt.Printf("applied\t%d\t%s\n", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+func backup(args []string) error {
+	if len(args) != 1 {
+		return log.NewError("usage: db backup <dest>")
+	}
+	err := db.Backup(args[0])
+	if err != nil {
+		return err
+	}
+	log.InfoLog("backed up to %s", args[0])
+	return nil
+}
+
+func vacuum(args []string) error {
+	err := db.CheckSchema()
+	if err != nil {
+		return err
+	}
+	return db.Vacuum()
+}
+
+// check prints a line per problem found and fails when there is any: the
+// integrity of the database, rows whose archived image is gone, codes whose
+// row is gone and files of the out dir no row refers to. Pending rows are
+// listed without counting as problems, their archived copy may still have
+// its temporary name, which run renames or removes.
+func check(args []string) error {
+	var problems int
+	report := func(format string, args ...interface{}) {
+		problems++
+		fmt.Printf(format+"\n", args...)
+	}
+	err := db.CheckSchema()
+	if err != nil {
+		return err
+	}
+	msgs, err := db.IntegrityCheck()
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		report("integrity\t%s", msg)
+	}
+	codes, err := db.OrphanCodes()
+	if err != nil {
+		return err
+	}
+	for _, id := range codes {
+		report("orphan code\t%d", id)
+	}
+
+	var stored = make(map[string]bool)
+	err = db.Each(context.Background(), &db.Filter{}, func(r *db.Record) error {
+		path, err := filepath.Abs(r.Path)
+		if err != nil {
+			return err
+		}
+		stored[path] = true
+		if r.State == db.Pending {
+			fmt.Printf("pending\t%d\t%s\n", r.ID, r.Path)
+			return nil
+		}
+		_, err = os.Stat(r.Path)
+		if err != nil {
+			report("missing\t%d\t%s", r.ID, r.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = filepath.Walk(img.OutDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, img.TempSuffix) {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if !stored[abs] {
+			report("orphan file\t%s", path)
+		}
+		return nil
+	})
+	if err != nil {
+		return log.NewError("walk out dir failed: %s", err.Error())
+	}
+	if problems > 0 {
+		return log.NewError("db check found %d problems", problems)
+	}
+	fmt.Println("ok")
+	return nil
+}
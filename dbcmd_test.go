@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"yangsi/db"
+	"yangsi/img"
+)
+
+func TestCheckPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = db.Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t"}`, filepath.Join(dir, "t.db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = img.Init([]byte(fmt.Sprintf(`{"out_dir":%q,"out_img":{"max_pixel":1000,"quality":80}}`, filepath.Join(dir, "out"))), filepath.Join(dir, "in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := archivePNG(t, dir)
+	err = check(nil)
+	if err != nil {
+		t.Fatalf("done row: %v", err)
+	}
+
+	// committed, its archived copy not renamed yet
+	err = os.Rename(r.Path, tempPath(r.Path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SetState(r.ID, db.Pending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = check(nil)
+	if err != nil {
+		t.Errorf("pending row: %v", err)
+	}
+
+	err = db.SetState(r.ID, db.Done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = check(nil)
+	if err == nil {
+		t.Error("done row without its archived copy passed")
+	}
+}
@@ -0,0 +1,275 @@
+package dispose
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+	"yangsi/log"
+)
+
+// What is done with an original once its record is stored.
+const (
+	Delete = "delete"
+	// to processed_dir, in the subdirectories it was in below the root dir
+	Move = "move"
+	// left where it is; the record says so and the next runs skip it
+	Keep = "keep"
+	// to trash_dir like Move, or to the trash of the desktop without one
+	Trash = "trash"
+)
+
+// config says what is done with the originals. Failed ones are moved to
+// quarantine_dir, with the error in a .error.txt next to each, when it is
+// set; they are left where they are otherwise.
+type config struct {
+	Mode          string `json:"mode"`
+	ProcessedDir  string `json:"processed_dir"`
+	TrashDir      string `json:"trash_dir"`
+	QuarantineDir string `json:"quarantine_dir"`
+}
+
+func (c *config) check() error {
+	switch c.Mode {
+	case Delete, Keep:
+	case Move:
+		if c.ProcessedDir == "" {
+			return log.NewError("disposition move needs processed_dir")
+		}
+	case Trash:
+		if c.TrashDir == "" && desktopTrash() == "" {
+			return log.NewError("no trash known on %s, disposition trash needs trash_dir", runtime.GOOS)
+		}
+	default:
+		return log.NewError("invalid disposition: %s, want delete, move, keep or trash", c.Mode)
+	}
+	return nil
+}
+
+var (
+	localConf = config{Mode: Delete}
+	root      string
+)
+
+// Init loads the config; rootDir is the dir originals are found in.
+func Init(cfg json.RawMessage, rootDir string) error {
+	root = path.Clean(strings.Replace(rootDir, "\\", "/", -1))
+	if len(cfg) > 0 {
+		err := json.Unmarshal(cfg, &localConf)
+		if err != nil {
+			return log.NewError("unmarshal disposition failed: %s, %s", string(cfg), err.Error())
+		}
+	}
+	return localConf.check()
+}
+
+// Mode is what is done with the originals.
+func Mode() string {
+	return localConf.Mode
+}
+
+// rel is the path of an original below the root dir.
+func rel(origPath string) string {
+	p := path.Clean(strings.Replace(origPath, "\\", "/", -1))
+	return strings.TrimPrefix(strings.TrimPrefix(p, root+"/"), "/")
+}
+
+// free is p, or p with _1, _2… before the extension if it is taken.
+func free(p string) (string, error) {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for n := 1; ; n++ {
+		_, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		p = fmt.Sprintf("%s_%d%s", base, n, ext)
+	}
+}
+
+// below is a free path in dir for the original at origPath, in the same
+// subdirectories.
+func below(dir, origPath string) (string, error) {
+	p := fmt.Sprintf("%s/%s", strings.TrimRight(dir, "/\\"), rel(origPath))
+	err := os.MkdirAll(path.Dir(p), os.ModePerm)
+	if err != nil {
+		return "", log.NewError("mkdir failed: %s, %s", path.Dir(p), err.Error())
+	}
+	return free(p)
+}
+
+// Destination is where the original at origPath is to go, "" when it is
+// deleted or kept. It is known before Original moves it, for the record.
+func Destination(origPath string) (string, error) {
+	switch localConf.Mode {
+	case Move:
+		return below(localConf.ProcessedDir, origPath)
+	case Trash:
+		if localConf.TrashDir != "" {
+			return below(localConf.TrashDir, origPath)
+		}
+		return trashPath(origPath)
+	}
+	return "", nil
+}
+
+// Original does with the original at origPath what mode says, dest being its
+// Destination. The mode is the one of its record, which may not be the one of
+// the config anymore when a pending record is finished.
+func Original(mode, origPath, dest string) error {
+	switch mode {
+	case Delete:
+		return os.Remove(origPath)
+	case Move:
+		return move(origPath, dest)
+	case Trash:
+		if inDesktopTrash(dest) {
+			err := trashInfo(origPath, dest)
+			if err != nil {
+				return err
+			}
+		}
+		return move(origPath, dest)
+	}
+	return nil
+}
+
+// move renames, or copies and removes across file systems.
+func move(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*os.LinkError); !ok {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	_, err = io.Copy(out, in)
+	in.Close()
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Quarantine moves a failed original to quarantine_dir with its error, if
+// that is set, and tells where it went.
+func Quarantine(origPath string, cause error) (string, error) {
+	if localConf.QuarantineDir == "" {
+		return "", nil
+	}
+	dest, err := below(localConf.QuarantineDir, origPath)
+	if err != nil {
+		return "", err
+	}
+	err = move(origPath, dest)
+	if err != nil {
+		return "", log.NewError("quarantine failed: %s, %s", origPath, err.Error())
+	}
+	note := fmt.Sprintf("%s\n%s\n%s\n", origPath, time.Now().Format("2006-01-02 15:04:05"), cause.Error())
+	err = ioutil.WriteFile(dest+".error.txt", []byte(note), os.ModePerm)
+	if err != nil {
+		return dest, log.NewError("write quarantine note failed: %s, %s", dest, err.Error())
+	}
+	return dest, nil
+}
+
+// Restore moves an original quarantined to dest back to origPath, dropping
+// its note.
+func Restore(dest, origPath string) error {
+	_, err := os.Stat(origPath)
+	if err == nil {
+		return log.NewError("restore failed: %s, %s is taken", dest, origPath)
+	}
+	err = os.MkdirAll(path.Dir(origPath), os.ModePerm)
+	if err != nil {
+		return log.NewError("mkdir failed: %s, %s", path.Dir(origPath), err.Error())
+	}
+	err = move(dest, origPath)
+	if err != nil {
+		return log.NewError("restore failed: %s, %s", dest, err.Error())
+	}
+	os.Remove(dest + ".error.txt")
+	return nil
+}
+
+// desktopTrash is the trash of the user as the freedesktop.org spec has it on
+// Linux and the BSDs, or ~/.Trash on macOS; "" on other systems.
+func desktopTrash() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(home, ".Trash")
+	case "windows", "plan9", "js", "android", "ios":
+		return ""
+	}
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		data = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(data, "Trash")
+}
+
+func trashPath(origPath string) (string, error) {
+	dir := desktopTrash()
+	if runtime.GOOS != "darwin" {
+		dir = filepath.Join(dir, "files")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", log.NewError("mkdir failed: %s, %s", dir, err.Error())
+	}
+	return free(filepath.ToSlash(filepath.Join(dir, path.Base(rel(origPath)))))
+}
+
+func inDesktopTrash(dest string) bool {
+	files := filepath.Join(desktopTrash(), "files")
+	return runtime.GOOS != "darwin" && desktopTrash() != "" &&
+		strings.HasPrefix(filepath.Clean(dest), files+string(filepath.Separator))
+}
+
+// trashInfo writes what the desktop needs to restore a file trashed to dest.
+func trashInfo(origPath, dest string) error {
+	if runtime.GOOS == "darwin" {
+		return nil
+	}
+	abs, err := filepath.Abs(origPath)
+	if err != nil {
+		return err
+	}
+	info := filepath.Join(filepath.Dir(filepath.Dir(dest)), "info", filepath.Base(dest)+".trashinfo")
+	err = os.MkdirAll(filepath.Dir(info), 0700)
+	if err != nil {
+		return err
+	}
+	u := url.URL{Path: filepath.ToSlash(abs)}
+	content := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n", u.EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	return ioutil.WriteFile(info, []byte(content), 0600)
+}
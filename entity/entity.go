@@ -0,0 +1,348 @@
+package entity
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"yangsi/db"
+)
+
+// Kinds of entities and how their values are normalized.
+const (
+	// digits only, without +86
+	Phone = "phone"
+	// "123.45 CNY"
+	Amount = "amount"
+	// "2006-01-02"
+	Date = "date"
+	URL  = "url"
+	// lower case
+	Email = "email"
+	// as printed after 订单号 and the like
+	Order = "order"
+	// an 18 character Chinese resident ID, X in upper case
+	ID = "id"
+	// a bank card number passing the Luhn check, digits only
+	Card = "card"
+)
+
+var Kinds = []string{Phone, Amount, Date, URL, Email, Order, ID, Card}
+
+var (
+	// a separator OCR keeps between digit groups
+	sep = `[ \-]?`
+
+	phoneRe    = regexp.MustCompile(`(?:\+?86` + sep + `)?1[3-9]\d` + sep + `\d{4}` + sep + `\d{4}`)
+	landlineRe = regexp.MustCompile(`0\d{2,3}[\-－]\d{7,8}`)
+	amountRe   = regexp.MustCompile(`(?i)(¥|￥|\$|€|RMB|CNY|USD|EUR)\s*(\d{1,3}(?:,\d{3})+|\d+)(\.\d{1,2})?` +
+		`|(\d{1,3}(?:,\d{3})+|\d+)(\.\d{1,2})?\s*(元|块|美元|欧元|RMB|CNY|USD|EUR)`)
+	dateRe  = regexp.MustCompile(`((?:19|20)\d{2})\s*[\-/.年]\s*(\d{1,2})\s*[\-/.月]\s*(\d{1,2})日?`)
+	urlRe   = regexp.MustCompile(`(?i)(?:https?://|www\.)[A-Za-z0-9\-._~:/?#\[\]@!$&'()*+,;=%]+`)
+	emailRe = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	orderRe = regexp.MustCompile(`(?i)(?:订单号|订单编号|交易单号|商户单号|流水号|order\s*(?:no\.?|number|id))\s*[:：]?\s*([A-Za-z0-9\-]{6,40})`)
+	cardRe  = regexp.MustCompile(`[3-6]\d{3}(?:` + sep + `\d{4}){2}` + sep + `\d{4,7}`)
+	idRe    = regexp.MustCompile(`[1-9]\d{5}(?:19|20)\d{2}(?:0[1-9]|1[0-2])(?:0[1-9]|[12]\d|3[01])\d{3}[\dXx]`)
+)
+
+var currencies = map[string]string{
+	"¥": "CNY", "￥": "CNY", "元": "CNY", "块": "CNY", "rmb": "CNY", "cny": "CNY",
+	"$": "USD", "美元": "USD", "usd": "USD",
+	"€": "EUR", "欧元": "EUR", "eur": "EUR",
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// alone tells whether the match [start, end) of text isn't part of a longer
+// run of digits or letters.
+func alone(text string, start, end int) bool {
+	isWord := func(b byte) bool {
+		return isDigit(b) || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+	}
+	return (start == 0 || !isWord(text[start-1])) && (end == len(text) || !isWord(text[end]))
+}
+
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// match is an entity found at text[start:end].
+type match struct {
+	kind, value string
+	start, end  int
+}
+
+// find returns every entity of text with where it is, grouped by kind in the
+// order of Kinds.
+func find(text string) []match {
+	var result []match
+	add := func(kind, value string, start, end int) {
+		if value != "" {
+			result = append(result, match{kind, value, start, end})
+		}
+	}
+
+	// IDs and cards first, so that the digits in them aren't taken for phones
+	var taken [][]int
+	for _, m := range idRe.FindAllStringIndex(text, -1) {
+		if alone(text, m[0], m[1]) {
+			taken = append(taken, m)
+			add(ID, strings.ToUpper(text[m[0]:m[1]]), m[0], m[1])
+		}
+	}
+	within := func(m []int) bool {
+		for _, t := range taken {
+			if m[0] >= t[0] && m[1] <= t[1] {
+				return true
+			}
+		}
+		return false
+	}
+	for _, m := range cardRe.FindAllStringIndex(text, -1) {
+		d := digits(text[m[0]:m[1]])
+		if alone(text, m[0], m[1]) && !within(m) && luhn(d) {
+			taken = append(taken, m)
+			add(Card, d, m[0], m[1])
+		}
+	}
+	for _, m := range phoneRe.FindAllStringIndex(text, -1) {
+		if alone(text, m[0], m[1]) && !within(m) {
+			d := digits(text[m[0]:m[1]])
+			add(Phone, d[len(d)-11:], m[0], m[1])
+		}
+	}
+	for _, m := range landlineRe.FindAllStringIndex(text, -1) {
+		if alone(text, m[0], m[1]) && !within(m) {
+			add(Phone, digits(text[m[0]:m[1]]), m[0], m[1])
+		}
+	}
+	for _, m := range amountRe.FindAllStringSubmatchIndex(text, -1) {
+		sub := func(k int) string {
+			if m[2*k] < 0 {
+				return ""
+			}
+			return text[m[2*k]:m[2*k+1]]
+		}
+		symbol, whole, frac := sub(1), sub(2), sub(3)
+		if symbol == "" {
+			whole, frac, symbol = sub(4), sub(5), sub(6)
+		}
+		add(Amount, amount(whole, frac, symbol), m[0], m[1])
+	}
+	for _, m := range dateRe.FindAllStringSubmatchIndex(text, -1) {
+		add(Date, date(text[m[2]:m[3]], text[m[4]:m[5]], text[m[6]:m[7]]), m[0], m[1])
+	}
+	for _, m := range urlRe.FindAllStringIndex(text, -1) {
+		raw := strings.TrimRight(text[m[0]:m[1]], ".,;:!?)]'")
+		add(URL, normalizeURL(raw), m[0], m[0]+len(raw))
+	}
+	for _, m := range emailRe.FindAllStringIndex(text, -1) {
+		add(Email, strings.ToLower(text[m[0]:m[1]]), m[0], m[1])
+	}
+	for _, m := range orderRe.FindAllStringSubmatchIndex(text, -1) {
+		add(Order, strings.ToUpper(text[m[2]:m[3]]), m[0], m[1])
+	}
+
+	// group by kind in the order of Kinds, keeping the order found within one
+	order := make(map[string]int, len(Kinds))
+	for k, kind := range Kinds {
+		order[kind] = k
+	}
+	sort.SliceStable(result, func(a, b int) bool {
+		return order[result[a].kind] < order[result[b].kind]
+	})
+	return result
+}
+
+// Extract finds the entities of text, each value once per kind, in the
+// order of Kinds.
+func Extract(text string) []db.Entity {
+	var result []db.Entity
+	var seen = make(map[string]bool)
+	for _, m := range find(text) {
+		if seen[m.kind+":"+m.value] {
+			continue
+		}
+		seen[m.kind+":"+m.value] = true
+		result = append(result, db.Entity{Kind: m.kind, Value: m.value, Raw: text[m.start:m.end]})
+	}
+	return result
+}
+
+// Spans returns where the entities of kinds are in text as [start, end)
+// byte offsets, in order and merged where they overlap.
+func Spans(text string, kinds ...string) [][2]int {
+	want := make(map[string]bool, len(kinds))
+	for _, kind := range kinds {
+		want[kind] = true
+	}
+	var spans [][2]int
+	for _, m := range find(text) {
+		if want[m.kind] {
+			spans = append(spans, [2]int{m.start, m.end})
+		}
+	}
+	sort.Slice(spans, func(a, b int) bool {
+		return spans[a][0] < spans[b][0]
+	})
+	var merged [][2]int
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s[0] <= merged[n-1][1] {
+			if s[1] > merged[n-1][1] {
+				merged[n-1][1] = s[1]
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// keep is how many letters or digits Mask leaves at the end of an entity.
+const keep = 4
+
+// Mask replaces the letters and digits of the entities of kinds in text with
+// '*', but for the last few, e.g. "6222 **** **** 1234".
+func Mask(text string, kinds ...string) string {
+	spans := Spans(text, kinds...)
+	if len(spans) == 0 {
+		return text
+	}
+	var buf strings.Builder
+	var last int
+	for _, s := range spans {
+		buf.WriteString(text[last:s[0]])
+		runes := []rune(text[s[0]:s[1]])
+		var left int
+		for k := len(runes) - 1; k >= 0; k-- {
+			if !unicode.IsLetter(runes[k]) && !unicode.IsDigit(runes[k]) {
+				continue
+			}
+			if left < keep {
+				left++
+				continue
+			}
+			runes[k] = '*'
+		}
+		buf.WriteString(string(runes))
+		last = s[1]
+	}
+	buf.WriteString(text[last:])
+	return buf.String()
+}
+
+// luhn tells whether the digits of a card number check out.
+func luhn(d string) bool {
+	var sum int
+	for k := len(d) - 1; k >= 0; k-- {
+		n := int(d[k] - '0')
+		if (len(d)-k)%2 == 0 {
+			n *= 2
+			if n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+// amount is the decimal value with two places and the currency code.
+func amount(whole, frac, symbol string) string {
+	v, err := strconv.ParseFloat(strings.Replace(whole, ",", "", -1)+frac, 64)
+	if err != nil {
+		return ""
+	}
+	currency, ok := currencies[strings.ToLower(symbol)]
+	if !ok {
+		currency = strings.ToUpper(symbol)
+	}
+	return fmt.Sprintf("%.2f %s", v, currency)
+}
+
+// date is the ISO date, "" if there is no such day.
+func date(year, month, day string) string {
+	y, _ := strconv.Atoi(year)
+	m, _ := strconv.Atoi(month)
+	d, _ := strconv.Atoi(day)
+	t := time.Date(y, time.Month(m), d, 0, 0, 0, 0, time.UTC)
+	if t.Year() != y || int(t.Month()) != m || t.Day() != d {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+// normalizeURL adds the scheme www. addresses go without and lowers the host.
+func normalizeURL(raw string) string {
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// FirstDate is the first date in s as "2006-01-02", or "".
+func FirstDate(s string) string {
+	for _, m := range dateRe.FindAllStringSubmatch(s, -1) {
+		if d := date(m[1], m[2], m[3]); d != "" {
+			return d
+		}
+	}
+	return ""
+}
+
+var decimalRe = regexp.MustCompile(`-?(\d{1,3}(?:,\d{3})+|\d+)(\.\d{1,2})?`)
+
+// FirstDecimal is the first number in s with two decimals, e.g. "1234.50"
+// for "¥1,234.5", or "".
+func FirstDecimal(s string) string {
+	m := decimalRe.FindString(s)
+	if m == "" {
+		return ""
+	}
+	v, err := strconv.ParseFloat(strings.Replace(m, ",", "", -1), 64)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%.2f", v)
+}
+
+// Known tells whether kind is one of Kinds.
+func Known(kind string) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefix turns the start of a value typed by hand into the start of a
+// normalized value of kind, e.g. "138 0013" to "1380013" for a phone.
+func Prefix(kind, value string) string {
+	switch kind {
+	case Phone, Card:
+		return digits(value)
+	case Email:
+		return strings.ToLower(value)
+	case ID, Amount:
+		return strings.ToUpper(value)
+	}
+	return value
+}
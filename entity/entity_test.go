@@ -0,0 +1,147 @@
+package entity
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLuhn(t *testing.T) {
+	var tests = []struct {
+		digits string
+		want   bool
+	}{
+		{"4111111111111111", true},
+		{"4111111111111112", false},
+		{"6222021234567890", false},
+		{"79927398713", true},
+		{"79927398710", false},
+	}
+	for _, tt := range tests {
+		if got := luhn(tt.digits); got != tt.want {
+			t.Errorf("luhn(%s) = %v, want %v", tt.digits, got, tt.want)
+		}
+	}
+}
+
+func TestDate(t *testing.T) {
+	var tests = []struct {
+		year, month, day string
+		want             string
+	}{
+		{"2023", "1", "5", "2023-01-05"},
+		{"2024", "02", "29", "2024-02-29"},
+		{"2023", "02", "29", ""},
+		{"2023", "13", "01", ""},
+		{"2023", "4", "31", ""},
+	}
+	for _, tt := range tests {
+		if got := date(tt.year, tt.month, tt.day); got != tt.want {
+			t.Errorf("date(%s, %s, %s) = %q, want %q", tt.year, tt.month, tt.day, got, tt.want)
+		}
+	}
+}
+
+func TestAmount(t *testing.T) {
+	var tests = []struct {
+		whole, frac, symbol string
+		want                string
+	}{
+		{"1,234", ".5", "¥", "1234.50 CNY"},
+		{"100", "", "元", "100.00 CNY"},
+		{"20", ".05", "usd", "20.05 USD"},
+		{"3", "", "€", "3.00 EUR"},
+		{"7", "", "GBP", "7.00 GBP"},
+	}
+	for _, tt := range tests {
+		if got := amount(tt.whole, tt.frac, tt.symbol); got != tt.want {
+			t.Errorf("amount(%s, %s, %s) = %q, want %q", tt.whole, tt.frac, tt.symbol, got, tt.want)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	var tests = []struct {
+		text       string
+		kind, want string
+	}{
+		{"电话 138-0013-8000", Phone, "13800138000"},
+		{"+86 138 0013 8000", Phone, "13800138000"},
+		{"座机 010-12345678", Phone, "01012345678"},
+		{"合计 ¥1,234.5", Amount, "1234.50 CNY"},
+		{"共 100元", Amount, "100.00 CNY"},
+		{"USD 20", Amount, "20.00 USD"},
+		{"2023年1月5日", Date, "2023-01-05"},
+		{"2023/12/31 23:59", Date, "2023-12-31"},
+		{"访问 www.Example.com/a.", URL, "http://www.example.com/a"},
+		{"Foo@Bar.com", Email, "foo@bar.com"},
+		{"订单号：ab123456", Order, "AB123456"},
+		{"身份证 11010519491231002x", ID, "11010519491231002X"},
+		{"卡号 4111 1111 1111 1111", Card, "4111111111111111"},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, e := range Extract(tt.text) {
+			if e.Kind == tt.kind {
+				got = append(got, e.Value)
+			}
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("Extract(%s) %s = %q, want %q", tt.text, tt.kind, got, tt.want)
+		}
+	}
+
+	var none = []struct {
+		text, kind string
+	}{
+		// no such day
+		{"2023-02-30", Date},
+		// fails the Luhn check
+		{"卡号 4111 1111 1111 1112", Card},
+		// part of a longer number
+		{"213800138000", Phone},
+	}
+	for _, tt := range none {
+		for _, e := range Extract(tt.text) {
+			if e.Kind == tt.kind {
+				t.Errorf("Extract(%s) found %s %q, want none", tt.text, tt.kind, e.Value)
+			}
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	var tests = []struct {
+		text  string
+		kinds []string
+		want  [][2]int
+	}{
+		{"a 13800138000 b foo@bar.com", []string{Phone, Email}, [][2]int{{2, 13}, {16, 27}}},
+		{"a 13800138000 b foo@bar.com", []string{Email}, [][2]int{{16, 27}}},
+		// the email inside the URL merges with it
+		{"www.a.com/x@b.cn", []string{URL, Email}, [][2]int{{0, 16}}},
+		{"nothing here", []string{Phone}, nil},
+	}
+	for _, tt := range tests {
+		if got := Spans(tt.text, tt.kinds...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Spans(%s, %v) = %v, want %v", tt.text, tt.kinds, got, tt.want)
+		}
+	}
+}
+
+func TestMask(t *testing.T) {
+	var tests = []struct {
+		text  string
+		kinds []string
+		want  string
+	}{
+		{"卡号 4111 1111 1111 1111", []string{Card}, "卡号 **** **** **** 1111"},
+		{"电话 13800138000", []string{Phone}, "电话 *******8000"},
+		{"电话 13800138000", []string{Card}, "电话 13800138000"},
+		{"Foo@Bar.com 13800138000", []string{Email, Phone}, "***@**r.com *******8000"},
+	}
+	for _, tt := range tests {
+		if got := Mask(tt.text, tt.kinds...); got != tt.want {
+			t.Errorf("Mask(%s, %v) = %q, want %q", tt.text, tt.kinds, got, tt.want)
+		}
+	}
+}
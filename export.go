@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"yangsi/db"
+	"yangsi/img"
+	"yangsi/log"
+)
+
+const (
+	thumbPixel = 240
+	// tells Excel the CSV is UTF-8
+	utf8BOM = "\ufeff"
+)
+
+// exporter writes records one by one; end is called after the last one.
+type exporter interface {
+	write(r *db.Record) error
+	end() error
+}
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "jsonl", "jsonl, csv, md or html")
+	out := fs.String("out", "", "file to write, stdout if empty")
+	from := fs.String("from", "", "only images modified at or after this date/time")
+	to := fs.String("to", "", "only images modified at or before this date/time")
+	path := fs.String("path", "", "only archived paths containing this")
+	tag := fs.String("tag", "", "only records with this tag")
+	var entities entityFlags
+	fs.Var(&entities, "entity", "only records with an entity of this kind whose value starts with this, kind[:value], repeatable")
+	terms, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "jsonl", "csv", "md", "html":
+	default:
+		return log.NewError("invalid export format: %s, want jsonl, csv, md or html", *format)
+	}
+	var filter = db.Filter{
+		Terms:    terms,
+		Path:     *path,
+		Tag:      *tag,
+		Entities: entities,
+	}
+	filter.From, err = parseTime(*from, false)
+	if err != nil {
+		return err
+	}
+	filter.To, err = parseTime(*to, true)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return log.NewError("create export file failed: %s", err.Error())
+		}
+		defer file.Close()
+		w = file
+	}
+	buf := bufio.NewWriter(w)
+	var e exporter
+	switch *format {
+	case "jsonl":
+		e = newJSONLExporter(buf)
+	case "csv":
+		e, err = newCSVExporter(buf)
+	case "md":
+		e, err = newMarkdownExporter(buf, &filter)
+	case "html":
+		e, err = newHTMLExporter(buf, &filter)
+	}
+	if err != nil {
+		return err
+	}
+	var n int
+	err = db.Each(context.Background(), &filter, func(r *db.Record) error {
+		n++
+		return e.write(r)
+	})
+	if err != nil {
+		return err
+	}
+	err = e.end()
+	if err != nil {
+		return err
+	}
+	err = buf.Flush()
+	if err != nil {
+		return log.NewError("write export failed: %s", err.Error())
+	}
+	log.InfoLog("exported %d records", n)
+	return nil
+}
+
+// describe sums up the filter for the title of a report.
+func describe(f *db.Filter) string {
+	var parts []string
+	if len(f.Terms) > 0 {
+		parts = append(parts, "“"+strings.Join(f.Terms, " ")+"”")
+	}
+	if !f.From.IsZero() {
+		parts = append(parts, "from "+f.From.Format(timeLayout))
+	}
+	if !f.To.IsZero() {
+		parts = append(parts, "to "+f.To.Format(timeLayout))
+	}
+	if f.Path != "" {
+		parts = append(parts, "path "+f.Path)
+	}
+	if f.Tag != "" {
+		parts = append(parts, "tag "+f.Tag)
+	}
+	for _, e := range f.Entities {
+		parts = append(parts, strings.TrimSuffix(e.Kind+" "+e.Value, " "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// thumbnail is the archived copy of r as a data URI, or "" when it can't be
+// read, which is logged but doesn't stop the report.
+func thumbnail(r *db.Record) string {
+	data, err := img.Thumbnail(r.Path, thumbPixel)
+	if err != nil {
+		log.WarnLog("thumbnail of %d failed: %s", r.ID, err.Error())
+		return ""
+	}
+	return "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// exportRecord is a record with the codes decoded from its image and its
+// tags, which the JSONL and CSV exports carry.
+type exportRecord struct {
+	*db.Record
+	Codes []db.Code `json:"codes"`
+	Tags  []string  `json:"tags"`
+}
+
+// withCodes reads the codes and tags of r. They are queried while the rows
+// are read, which SQLite allows as long as nothing is written.
+func withCodes(r *db.Record) (*exportRecord, error) {
+	codes, err := db.Codes(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := db.Tags(r.ID)
+	if err != nil {
+		return nil, err
+	}
+	if codes == nil {
+		codes = []db.Code{}
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	return &exportRecord{r, codes, tags}, nil
+}
+
+type jsonlExporter struct {
+	enc *json.Encoder
+}
+
+func newJSONLExporter(w io.Writer) *jsonlExporter {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &jsonlExporter{enc}
+}
+
+func (e *jsonlExporter) write(r *db.Record) error {
+	er, err := withCodes(r)
+	if err != nil {
+		return err
+	}
+	return e.enc.Encode(er)
+}
+
+func (e *jsonlExporter) end() error {
+	return nil
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+var csvHeader = []string{"id", "time", "path", "text", "orig_path", "orig_name", "size", "width",
+	"height", "format", "sha256", "ocr_engine", "ocr_endpoint", "ocr_ms", "processed_at", "direction",
+	"confidence", "note", "corrected_text", "camera", "disposition", "disposed_path", "codes", "tags"}
+
+func newCSVExporter(w io.Writer) (*csvExporter, error) {
+	_, err := io.WriteString(w, utf8BOM)
+	if err != nil {
+		return nil, err
+	}
+	e := &csvExporter{csv.NewWriter(w)}
+	// Excel keeps line breaks inside quoted cells only with CRLF
+	e.w.UseCRLF = true
+	return e, e.w.Write(csvHeader)
+}
+
+func (e *csvExporter) write(r *db.Record) error {
+	er, err := withCodes(r)
+	if err != nil {
+		return err
+	}
+	// codes and tags a line each, as they may hold commas
+	var payloads = make([]string, len(er.Codes))
+	for k, c := range er.Codes {
+		payloads[k] = c.Payload
+	}
+	var processedAt string
+	if !r.ProcessedAt.IsZero() {
+		processedAt = r.ProcessedAt.Format(timeLayout)
+	}
+	return e.w.Write([]string{
+		strconv.FormatInt(r.ID, 10),
+		r.Time.Format(timeLayout),
+		r.Path,
+		r.Text,
+		r.OrigPath,
+		r.OrigName,
+		strconv.FormatInt(r.Size, 10),
+		strconv.Itoa(r.Width),
+		strconv.Itoa(r.Height),
+		r.Format,
+		r.SHA256,
+		r.OCREngine,
+		r.OCREndpoint,
+		strconv.FormatInt(r.OCRMillis, 10),
+		processedAt,
+		strconv.Itoa(r.Direction),
+		strconv.FormatFloat(r.Confidence, 'f', -1, 64),
+		r.Note,
+		r.CorrectedText,
+		r.Camera,
+		r.Disposition,
+		r.DisposedPath,
+		strings.Join(payloads, "\n"),
+		strings.Join(er.Tags, "\n"),
+	})
+}
+
+func (e *csvExporter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// markdownExporter writes a section per record with its thumbnail embedded
+// and its text as a code block, which keeps it as it is.
+type markdownExporter struct {
+	w io.Writer
+}
+
+func newMarkdownExporter(w io.Writer, f *db.Filter) (*markdownExporter, error) {
+	title := "# yangsi export"
+	if d := describe(f); d != "" {
+		title += ": " + d
+	}
+	_, err := fmt.Fprintf(w, "%s\n\n", title)
+	return &markdownExporter{w}, err
+}
+
+func (e *markdownExporter) write(r *db.Record) error {
+	_, err := fmt.Fprintf(e.w, "## %d · %s\n\n`%s`\n\n", r.ID, r.Time.Format(timeLayout), r.Path)
+	if err != nil {
+		return err
+	}
+	if uri := thumbnail(r); uri != "" {
+		_, err = fmt.Fprintf(e.w, "![%d](%s)\n\n", r.ID, uri)
+		if err != nil {
+			return err
+		}
+	}
+	fence := "```"
+	for strings.Contains(r.Content(), fence) {
+		fence += "`"
+	}
+	_, err = fmt.Fprintf(e.w, "%s\n%s\n%[1]s\n\n", fence, r.Content())
+	return err
+}
+
+func (e *markdownExporter) end() error {
+	return nil
+}
+
+// htmlExporter writes a single page, the records as rows of a table.
+type htmlExporter struct {
+	w io.Writer
+}
+
+type htmlRow struct {
+	*db.Record
+	Thumb template.URL
+}
+
+var htmlTpl = template.Must(template.New("head").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.}}</title>
+<style>
+body{font-family:sans-serif;margin:2em}
+table{border-collapse:collapse;width:100%}
+td,th{border:1px solid #ccc;padding:.5em;vertical-align:top;text-align:left}
+td pre{white-space:pre-wrap;margin:0;font-family:inherit}
+</style></head><body>
+<h1>{{.}}</h1>
+<table><tr><th>#</th><th>time</th><th>image</th><th>text</th></tr>
+`))
+
+var htmlRowTpl = template.Must(template.New("row").Parse(`<tr><td>{{.ID}}</td><td>{{.Time.Format "2006-01-02 15:04:05"}}<br><small>{{.Path}}</small></td><td>{{if .Thumb}}<img src="{{.Thumb}}" alt="{{.ID}}">{{end}}</td><td><pre>{{.Content}}</pre></td></tr>
+`))
+
+func newHTMLExporter(w io.Writer, f *db.Filter) (*htmlExporter, error) {
+	title := "yangsi export"
+	if d := describe(f); d != "" {
+		title += ": " + d
+	}
+	return &htmlExporter{w}, htmlTpl.Execute(w, title)
+}
+
+func (e *htmlExporter) write(r *db.Record) error {
+	// thumbnail only returns data URIs of our own JPEGs
+	return htmlRowTpl.Execute(e.w, htmlRow{r, template.URL(thumbnail(r))})
+}
+
+func (e *htmlExporter) end() error {
+	_, err := io.WriteString(e.w, "</table></body></html>\n")
+	return err
+}
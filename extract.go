@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"yangsi/db"
+	"yangsi/entity"
+	"yangsi/log"
+)
+
+// extract finds the entities of every record again, for the records stored
+// before they were extracted or after the patterns changed.
+func extract(args []string) error {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the entities found in each record")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	var total, found int
+	for offset := 0; ; offset += retagBatch {
+		records, err := db.Find(&db.Filter{Limit: retagBatch, Offset: offset})
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		total += len(records)
+		if *dryRun {
+			for k := range records {
+				for _, e := range entity.Extract(records[k].Content()) {
+					found++
+					fmt.Printf("%d\t%s\t%s\t%s\n", records[k].ID, e.Kind, e.Value, e.Raw)
+				}
+			}
+			continue
+		}
+		err = inTx(func(tx *sql.Tx) error {
+			for k := range records {
+				entities := entity.Extract(records[k].Content())
+				found += len(entities)
+				err := db.SetEntities(tx, records[k].ID, entities)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.InfoLog("%d entities found in %d records", found, total)
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"yangsi/db"
+	"yangsi/dispose"
+	"yangsi/log"
+)
+
+var failuresCommands = map[string]func(args []string) error{
+	"list":  failuresList,
+	"retry": failuresRetry,
+}
+
+func failuresCommand(args []string) error {
+	if len(args) == 0 || failuresCommands[args[0]] == nil {
+		return log.NewError("unknown failures command: %v, want list or retry", args)
+	}
+	return failuresCommands[args[0]](args[1:])
+}
+
+func checkStage(stage string) error {
+	if stage == "" {
+		return nil
+	}
+	for _, s := range db.Stages {
+		if s == stage {
+			return nil
+		}
+	}
+	return log.NewError("unknown stage: %s, want one of %s", stage, strings.Join(db.Stages, ", "))
+}
+
+// failuresList prints the last failure of each file still failed, or every
+// failure recorded with -all, oldest first.
+func failuresList(args []string) error {
+	fs := flag.NewFlagSet("failures list", flag.ExitOnError)
+	stage := fs.String("stage", "", "only failures at this stage: "+strings.Join(db.Stages, ", "))
+	all := fs.Bool("all", false, "every failure recorded, of files stored since too")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = checkStage(*stage)
+	if err != nil {
+		return err
+	}
+	failures, err := db.Failures(*stage, *all)
+	if err != nil {
+		return err
+	}
+	for _, f := range failures {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", f.Time.Format("2006-01-02 15:04:05"), f.Stage, f.Class, f.Path,
+			f.Quarantined, strings.Join(strings.Fields(f.Error), " "))
+	}
+	log.InfoLog("%d failures", len(failures))
+	return nil
+}
+
+// failuresRetry makes the given files, or every failed one, pending again
+// for the next run to try, whatever their class and attempts. Quarantined
+// ones are moved back first.
+func failuresRetry(args []string) error {
+	fs := flag.NewFlagSet("failures retry", flag.ExitOnError)
+	stage := fs.String("stage", "", "only files that failed at this stage: "+strings.Join(db.Stages, ", "))
+	paths, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	err = checkStage(*stage)
+	if err != nil {
+		return err
+	}
+	jobs, err := db.FailedJobs(*stage)
+	if err != nil {
+		return err
+	}
+	var wanted = make(map[string]bool)
+	for _, p := range paths {
+		wanted[transformPath(p)] = true
+	}
+	var n int
+	for _, j := range jobs {
+		if len(wanted) > 0 && !wanted[j.Path] {
+			continue
+		}
+		if _, err := os.Stat(j.Path); os.IsNotExist(err) {
+			f, err := db.LastFailure(j.Path)
+			if err != nil {
+				return err
+			}
+			if f == nil || f.Quarantined == "" {
+				log.WarnLog("%s is gone, not retried", j.Path)
+				continue
+			}
+			err = dispose.Restore(f.Quarantined, j.Path)
+			if err != nil {
+				log.WriteError(err, "%s not retried", j.Path)
+				continue
+			}
+			log.InfoLog("%s moved back from %s", j.Path, f.Quarantined)
+		}
+		err = db.ResetJob(j.Path)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	log.InfoLog("%d files to be tried again by the next run", n)
+	return nil
+}
@@ -0,0 +1,139 @@
+package img
+
+import (
+	"image"
+	"math"
+
+	"github.com/makiuchi-d/gozxing"
+	multiqr "github.com/makiuchi-d/gozxing/multi/qrcode"
+	"github.com/makiuchi-d/gozxing/oned"
+)
+
+// Barcode is a QR code or 1D barcode found in an image.
+type Barcode struct {
+	Format  string
+	Payload string
+}
+
+var barcodeHints = map[gozxing.DecodeHintType]interface{}{
+	gozxing.DecodeHintType_TRY_HARDER: true,
+}
+
+const (
+	// how many times the parts around a 1D barcode are searched again for
+	// another one
+	maxBarcodeDepth = 4
+	// parts narrower or lower than this hold no barcode worth reading
+	minBarcodeSide = 24
+)
+
+// Barcodes decodes the QR codes and barcodes of every frame locally, dropping
+// payloads seen in an earlier frame.
+func (i *Image) Barcodes() []Barcode {
+	var result []Barcode
+	var seen = make(map[string]bool)
+	for _, frame := range i.Frames {
+		for _, code := range decodeBarcodes(frame) {
+			if !seen[code.Payload] {
+				seen[code.Payload] = true
+				result = append(result, code)
+			}
+		}
+	}
+	return result
+}
+
+// decodeBarcodes finds every QR code of img in one pass. The 1D readers stop
+// at the first code, so as zxing's GenericMultipleBarcodeReader does, the
+// parts left, right, above and below it are searched again.
+func decodeBarcodes(img image.Image) []Barcode {
+	var result []Barcode
+	var seen = make(map[Barcode]bool)
+	add := func(code *gozxing.Result) {
+		b := Barcode{Format: code.GetBarcodeFormat().String(), Payload: code.GetText()}
+		if b.Payload != "" && !seen[b] {
+			seen[b] = true
+			result = append(result, b)
+		}
+	}
+	bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+	if err != nil {
+		return nil
+	}
+	// not finding anything is reported as an error too
+	codes, err := multiqr.NewQRCodeMultiReader().DecodeMultiple(bmp, barcodeHints)
+	if err == nil {
+		for _, code := range codes {
+			add(code)
+		}
+	}
+	decodeOneD(img, bmp, add, 0)
+	return result
+}
+
+func oneDReaders() []gozxing.Reader {
+	return []gozxing.Reader{
+		oned.NewMultiFormatUPCEANReader(barcodeHints),
+		oned.NewCode128Reader(),
+		oned.NewCode39Reader(),
+		oned.NewCode93Reader(),
+		oned.NewITFReader(),
+		oned.NewCodaBarReader(),
+	}
+}
+
+func decodeOneD(img image.Image, bmp *gozxing.BinaryBitmap, add func(*gozxing.Result), depth int) {
+	for _, reader := range oneDReaders() {
+		code, err := reader.Decode(bmp, barcodeHints)
+		if err != nil {
+			continue
+		}
+		add(code)
+		if depth >= maxBarcodeDepth {
+			return
+		}
+		around := codeBounds(img.Bounds(), code.GetResultPoints())
+		if around.Empty() {
+			return
+		}
+		b := img.Bounds()
+		for _, part := range []image.Rectangle{
+			image.Rect(b.Min.X, b.Min.Y, around.Min.X, b.Max.Y),
+			image.Rect(around.Max.X, b.Min.Y, b.Max.X, b.Max.Y),
+			image.Rect(b.Min.X, b.Min.Y, b.Max.X, around.Min.Y),
+			image.Rect(b.Min.X, around.Max.Y, b.Max.X, b.Max.Y),
+		} {
+			if part.Dx() < minBarcodeSide || part.Dy() < minBarcodeSide {
+				continue
+			}
+			sub := crop(img, part)
+			subBmp, err := gozxing.NewBinaryBitmapFromImage(sub)
+			if err == nil {
+				decodeOneD(sub, subBmp, add, depth+1)
+			}
+		}
+		return
+	}
+}
+
+// codeBounds is the rectangle of the result points of a code in an image with
+// bounds b, the points being relative to b.Min.
+func codeBounds(b image.Rectangle, points []gozxing.ResultPoint) image.Rectangle {
+	if len(points) == 0 {
+		return image.Rectangle{}
+	}
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range points {
+		if p == nil {
+			continue
+		}
+		minX, maxX = math.Min(minX, p.GetX()), math.Max(maxX, p.GetX())
+		minY, maxY = math.Min(minY, p.GetY()), math.Max(maxY, p.GetY())
+	}
+	if math.IsInf(minX, 0) {
+		return image.Rectangle{}
+	}
+	r := image.Rect(int(minX), int(minY), int(math.Ceil(maxX))+1, int(math.Ceil(maxY))+1)
+	return r.Add(b.Min).Intersect(b)
+}
@@ -0,0 +1,56 @@
+package img
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/makiuchi-d/gozxing/qrcode"
+)
+
+// encode draws a code of format and payload w by h pixels.
+func encode(t *testing.T, writer gozxing.Writer, format gozxing.BarcodeFormat, payload string, w, h int) image.Image {
+	m, err := writer.Encode(payload, format, w, h, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestBarcodes(t *testing.T) {
+	var codes = []struct {
+		img image.Image
+		at  image.Point
+	}{
+		{encode(t, qrcode.NewQRCodeWriter(), gozxing.BarcodeFormat_QR_CODE, "https://example.com/a", 200, 200), image.Pt(20, 20)},
+		{encode(t, qrcode.NewQRCodeWriter(), gozxing.BarcodeFormat_QR_CODE, "second", 200, 200), image.Pt(380, 20)},
+		{encode(t, oned.NewCode128Writer(), gozxing.BarcodeFormat_CODE_128, "ABC-12345", 400, 100), image.Pt(20, 300)},
+	}
+	page := image.NewRGBA(image.Rect(0, 0, 640, 440))
+	draw.Draw(page, page.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	for _, c := range codes {
+		draw.Draw(page, c.img.Bounds().Add(c.at), c.img, c.img.Bounds().Min, draw.Src)
+	}
+
+	i := &Image{Frames: []image.Image{page, page}}
+	got := make(map[Barcode]int)
+	for _, code := range i.Barcodes() {
+		got[code]++
+	}
+	for _, want := range []Barcode{
+		{"QR_CODE", "https://example.com/a"},
+		{"QR_CODE", "second"},
+		{"CODE_128", "ABC-12345"},
+	} {
+		if got[want] != 1 {
+			t.Errorf("%v found %d times, want once", want, got[want])
+		}
+		delete(got, want)
+	}
+	for code := range got {
+		t.Errorf("%v found, want none", code)
+	}
+}
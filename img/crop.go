@@ -0,0 +1,119 @@
+package img
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"path/filepath"
+	"yangsi/log"
+)
+
+const (
+	unitPixel   = "px"
+	unitPercent = "percent"
+)
+
+// cropRule trims margins off the copy sent to OCR, e.g. the status and nav
+// bars of phone screenshots. Margins are in pixels of the original image or in
+// percent of its size. A rule applies when both its glob (matched against the
+// path below the root dir, "screenshots/*.png", and the file name) and its
+// size profile ("1080x2400") of the original match; an empty glob or size
+// matches everything.
+type cropRule struct {
+	Glob   string  `json:"glob"`
+	Size   string  `json:"size"`
+	Unit   string  `json:"unit"`
+	Top    float64 `json:"top"`
+	Bottom float64 `json:"bottom"`
+	Left   float64 `json:"left"`
+	Right  float64 `json:"right"`
+	width  int
+	height int
+}
+
+func (r *cropRule) check() error {
+	if r.Glob != "" {
+		if _, err := filepath.Match(filepath.FromSlash(r.Glob), ""); err != nil {
+			return log.NewError("invalid crop glob: %s, %s", r.Glob, err.Error())
+		}
+	}
+	if r.Size != "" {
+		_, err := fmt.Sscanf(r.Size, "%dx%d", &r.width, &r.height)
+		if err != nil || r.width <= 0 || r.height <= 0 {
+			return log.NewError("invalid crop size: %s", r.Size)
+		}
+	}
+	switch r.Unit {
+	case "":
+		r.Unit = unitPixel
+	case unitPixel, unitPercent:
+	default:
+		return log.NewError("invalid crop unit: %s", r.Unit)
+	}
+	if r.Top < 0 || r.Bottom < 0 || r.Left < 0 || r.Right < 0 {
+		return log.NewError("invalid crop margins: %+v", *r)
+	}
+	if r.Unit == unitPercent && (r.Top+r.Bottom >= 100 || r.Left+r.Right >= 100) {
+		return log.NewError("invalid crop margins: %+v", *r)
+	}
+	return nil
+}
+
+func (r *cropRule) match(i *Image) bool {
+	if r.width != 0 && (r.width != i.Width || r.height != i.Height) {
+		return false
+	}
+	if r.Glob == "" {
+		return true
+	}
+	p := i.Path()
+	if i.origPath != "" {
+		p = i.origPath
+	}
+	glob := filepath.FromSlash(r.Glob)
+	if rel, err := filepath.Rel(root, filepath.FromSlash(p)); err == nil {
+		if ok, _ := filepath.Match(glob, rel); ok {
+			return true
+		}
+	}
+	ok, _ := filepath.Match(glob, filepath.Base(filepath.FromSlash(p)))
+	return ok
+}
+
+// rect maps the margins onto the bounds of the (possibly downsampled) image.
+func (r *cropRule) rect(b image.Rectangle, oWidth, oHeight int) image.Rectangle {
+	var sx, sy = 1.0, 1.0
+	if r.Unit == unitPercent {
+		sx, sy = float64(b.Dx())/100, float64(b.Dy())/100
+	} else if oWidth > 0 && oHeight > 0 {
+		sx, sy = float64(b.Dx())/float64(oWidth), float64(b.Dy())/float64(oHeight)
+	}
+	return image.Rect(
+		b.Min.X+int(r.Left*sx),
+		b.Min.Y+int(r.Top*sy),
+		b.Max.X-int(r.Right*sx),
+		b.Max.Y-int(r.Bottom*sy),
+	).Intersect(b)
+}
+
+func matchCrop(i *Image) *cropRule {
+	for k := range localConf.Crop {
+		if localConf.Crop[k].match(i) {
+			return &localConf.Crop[k]
+		}
+	}
+	return nil
+}
+
+type subImager interface {
+	SubImage(r image.Rectangle) image.Image
+}
+
+func crop(img image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := img.(subImager); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
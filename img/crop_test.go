@@ -0,0 +1,82 @@
+package img
+
+import (
+	"image"
+	"testing"
+)
+
+func TestCropRuleMatch(t *testing.T) {
+	root = "origin"
+	var tests = []struct {
+		name string
+		rule cropRule
+		img  Image
+		want bool
+	}{
+		{"empty rule", cropRule{}, Image{Dir: "./origin", Basename: "a", Format: "png"}, true},
+		{"file name", cropRule{Glob: "Screenshot_*.png"}, Image{Dir: "./origin/phone", Basename: "Screenshot_1", Format: "png"}, true},
+		{"file name differs", cropRule{Glob: "Screenshot_*.png"}, Image{Dir: "./origin/phone", Basename: "IMG_1", Format: "png"}, false},
+		{"below root", cropRule{Glob: "phone/*.png"}, Image{Dir: "./origin/phone", Basename: "a", Format: "png"}, true},
+		{"other dir below root", cropRule{Glob: "phone/*.png"}, Image{Dir: "./origin/scans", Basename: "a", Format: "png"}, false},
+		{"file name in a subdir", cropRule{Glob: "*.png"}, Image{Dir: "./origin/phone/2026", Basename: "a", Format: "png"}, true},
+		{"dir glob doesn't cross dirs", cropRule{Glob: "phone/*.png"}, Image{Dir: "./origin/phone/2026", Basename: "a", Format: "png"}, false},
+		{"deeper dir", cropRule{Glob: "phone/*/*.png"}, Image{Dir: "./origin/phone/2026", Basename: "a", Format: "png"}, true},
+		{"size", cropRule{Size: "1080x2400"}, Image{Dir: "./origin", Basename: "a", Format: "png", Width: 1080, Height: 2400}, true},
+		{"size differs", cropRule{Size: "1080x2400"}, Image{Dir: "./origin", Basename: "a", Format: "png", Width: 2400, Height: 1080}, false},
+		{"glob and size", cropRule{Glob: "phone/*", Size: "1080x2400"}, Image{Dir: "./origin/phone", Basename: "a", Format: "jpg", Width: 1080, Height: 2400}, true},
+		{"archived copy as original", cropRule{Glob: "phone/*.png", Size: "1080x2400"},
+			Image{Dir: "./out/20261019", Basename: "a_o", Format: "png", Width: 864, Height: 1920, origPath: "./origin/phone/a.png"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.check(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := tt.rule.match(&tt.img); got != tt.want {
+			t.Errorf("%s: match %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// reocr loads the downsampled copy, the record tells the original size
+	rule := cropRule{Glob: "phone/*.png", Size: "1080x2400"}
+	rule.check()
+	archived := Image{Dir: "./out/20261019", Basename: "a_o", Format: "png", Width: 864, Height: 1920}
+	archived.AsOriginal("./origin/phone/a.png", 1080, 2400)
+	if !rule.match(&archived) {
+		t.Error("archived copy taken for its original: no match")
+	}
+}
+
+func TestCropRuleInvalid(t *testing.T) {
+	for _, r := range []cropRule{
+		{Glob: "[a"},
+		{Size: "1080"},
+		{Size: "0x10"},
+		{Unit: "mm"},
+		{Top: -1},
+		{Unit: unitPercent, Top: 50, Bottom: 50},
+	} {
+		if err := r.check(); err == nil {
+			t.Errorf("%+v: no error", r)
+		}
+	}
+}
+
+func TestCropRuleRect(t *testing.T) {
+	var tests = []struct {
+		name string
+		rule cropRule
+		b    image.Rectangle
+		w, h int
+		want image.Rectangle
+	}{
+		{"pixels", cropRule{Unit: unitPixel, Top: 100, Bottom: 200}, image.Rect(0, 0, 1080, 2400), 1080, 2400, image.Rect(0, 100, 1080, 2200)},
+		{"pixels of the original on a copy half its size", cropRule{Unit: unitPixel, Top: 100, Left: 40}, image.Rect(0, 0, 540, 1200), 1080, 2400, image.Rect(20, 50, 540, 1200)},
+		{"percent", cropRule{Unit: unitPercent, Top: 10, Right: 25}, image.Rect(0, 0, 400, 200), 800, 400, image.Rect(0, 20, 300, 200)},
+		{"more than there is", cropRule{Unit: unitPixel, Top: 300}, image.Rect(0, 0, 100, 200), 100, 200, image.Rectangle{}},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.rect(tt.b, tt.w, tt.h); !got.Eq(tt.want) {
+			t.Errorf("%s: rect %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
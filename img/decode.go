@@ -0,0 +1,307 @@
+package img
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"sync"
+	"yangsi/log"
+)
+
+const (
+	defaultMaxPixels = 100 * 1000 * 1000
+	defaultMemoryMB  = 512
+	megabyte         = 1024 * 1024
+)
+
+// loadStill decodes a single image file within the decode limits and returns
+// it downsampled along with its original size. The format is told by the
+// contents rather than the extension, archived copies being JPEG whatever
+// they are named.
+func loadStill(path string) (image.Image, int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+	conf, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, 0, 0, log.NewWarn("decode config failed: %s, %s", path, err.Error())
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if format == fmtJPEG {
+		return loadJPEG(path, file, conf)
+	}
+	cost, err := decodeCost(path, conf, uint64(conf.Width)*uint64(conf.Height)*bytesPerPixel(conf.ColorModel))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	budget.acquire(cost)
+	defer budget.release(cost)
+	raw, _, err := image.Decode(file)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return downsample(path, raw), conf.Width, conf.Height, nil
+}
+
+// loadJPEG is loadStill for a JPEG. One too large to decode in full is
+// decoded at 1/8 of its size from the DC coefficients alone, see scaled.go,
+// as long as that fits the limits.
+func loadJPEG(path string, file *os.File, conf image.Config) (image.Image, int, int, error) {
+	frame, err := readFrame(file)
+	if err != nil {
+		return nil, 0, 0, log.NewWarn("decode config failed: %s, %s", path, err.Error())
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	decode := jpeg.Decode
+	cost, err := decodeCost(path, conf, frame.cost())
+	if err != nil {
+		small := image.Config{ColorModel: conf.ColorModel, Width: (conf.Width + 7) / 8, Height: (conf.Height + 7) / 8}
+		var scaledErr error
+		cost, scaledErr = decodeCost(path, small, frame.scaledCost())
+		if scaledErr != nil {
+			return nil, 0, 0, err
+		}
+		log.RealtimeLog("decoding %s at 1/8 scale: %dx%d -> %dx%d", path, conf.Width, conf.Height, small.Width, small.Height)
+		decode = decodeScaled
+	}
+	budget.acquire(cost)
+	defer budget.release(cost)
+	raw, err := decode(file)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return downsample(path, raw), conf.Width, conf.Height, nil
+}
+
+func downsample(path string, raw image.Image) image.Image {
+	img := resize(raw, rzOption{
+		MaxPixel: localConf.OutImg.MaxPixel,
+	})
+	if img != raw {
+		from, to := raw.Bounds(), img.Bounds()
+		log.RealtimeLog("downsampled %s: %dx%d -> %dx%d", path, from.Dx(), from.Dy(), to.Dx(), to.Dy())
+	}
+	return img
+}
+
+// bytesPerPixel is what the std decoders allocate for one pixel of the given
+// color model. JPEGs are costed by their frame header instead.
+func bytesPerPixel(m color.Model) uint64 {
+	switch m {
+	case color.GrayModel:
+		return 1
+	case color.Gray16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.CMYKModel, color.RGBAModel, color.NRGBAModel:
+		return 4
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := m.(color.Palette); ok {
+		return 1
+	}
+	return 8
+}
+
+// jpegFrame is what the frame header of a JPEG tells about decoding it.
+type jpegFrame struct {
+	width, height uint64
+	progressive   bool
+	// RGB rather than YCbCr, told by an Adobe APP14 segment or the ids
+	rgb bool
+	// id, sampling factors and quantization table of every component
+	comps []byte
+	// the largest sampling factors and the number of MCUs across and down
+	hMax, vMax   uint64
+	mcusX, mcusY uint64
+}
+
+// readFrame reads a JPEG up to its frame header.
+func readFrame(r io.Reader) (*jpegFrame, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	_, err := io.ReadFull(br, soi[:])
+	if err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, errors.New("missing SOI marker")
+	}
+	var adobeRGB bool
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if c != 0xff {
+			return nil, errors.New("invalid marker")
+		}
+		marker := byte(0xff)
+		for marker == 0xff {
+			marker, err = br.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			continue
+		}
+		var size [2]byte
+		_, err = io.ReadFull(br, size[:])
+		if err != nil {
+			return nil, err
+		}
+		n := int(size[0])<<8 | int(size[1]) - 2
+		if n < 0 {
+			return nil, errors.New("invalid segment length")
+		}
+		seg := make([]byte, n)
+		_, err = io.ReadFull(br, seg)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case marker == 0xee && n >= 12 && string(seg[:5]) == "Adobe":
+			adobeRGB = seg[11] == 0
+		case marker == 0xda:
+			return nil, errors.New("scan before frame header")
+		case marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			return parseFrame(seg, marker&3 == 2, adobeRGB)
+		}
+	}
+}
+
+func parseFrame(seg []byte, progressive, adobeRGB bool) (*jpegFrame, error) {
+	if len(seg) < 6 || len(seg) < 6+3*int(seg[5]) || seg[5] == 0 {
+		return nil, errors.New("invalid frame header")
+	}
+	f := &jpegFrame{
+		height:      uint64(seg[1])<<8 | uint64(seg[2]),
+		width:       uint64(seg[3])<<8 | uint64(seg[4]),
+		progressive: progressive,
+		comps:       seg[6 : 6+3*int(seg[5])],
+		hMax:        1,
+		vMax:        1,
+	}
+	for k := 0; k < len(f.comps); k += 3 {
+		h, v := uint64(f.comps[k+1]>>4), uint64(f.comps[k+1]&0x0f)
+		if h == 0 || v == 0 {
+			return nil, errors.New("invalid sampling factor")
+		}
+		if h > f.hMax {
+			f.hMax = h
+		}
+		if v > f.vMax {
+			f.vMax = v
+		}
+	}
+	f.mcusX = (f.width + 8*f.hMax - 1) / (8 * f.hMax)
+	f.mcusY = (f.height + 8*f.vMax - 1) / (8 * f.vMax)
+	nc := len(f.comps) / 3
+	f.rgb = adobeRGB || (nc == 3 && f.comps[0] == 'R' && f.comps[3] == 'G' && f.comps[6] == 'B')
+	return f, nil
+}
+
+// blocks is how many 8x8 blocks the planes of every component hold.
+func (f *jpegFrame) blocks() uint64 {
+	var n uint64
+	for k := 0; k < len(f.comps); k += 3 {
+		n += f.mcusX * uint64(f.comps[k+1]>>4) * f.mcusY * uint64(f.comps[k+1]&0x0f)
+	}
+	return n
+}
+
+// cost is what image/jpeg allocates to decode the JPEG: the planes of every
+// component padded to whole blocks, an RGB or CMYK copy when it converts to
+// one, and for progressive JPEGs a 64-coefficient int32 block per 8x8 block,
+// 4 bytes a sample, kept until the last scan.
+func (f *jpegFrame) cost() uint64 {
+	samples := 64 * f.blocks()
+	cost := samples
+	if f.progressive {
+		cost += 4 * samples
+	}
+	if nc := len(f.comps) / 3; nc == 4 || (nc == 3 && f.rgb) {
+		cost += 4 * f.width * f.height
+	}
+	return cost
+}
+
+// scaledCost is what decodeScaled allocates: an int32 DC coefficient per
+// block and the RGBA image at 1/8 of the size.
+func (f *jpegFrame) scaledCost() uint64 {
+	return 4*f.blocks() + 4*((f.width+7)/8)*((f.height+7)/8)
+}
+
+// jpegCost is the cost of decoding the JPEG in r in full.
+func jpegCost(r io.Reader) (uint64, error) {
+	f, err := readFrame(r)
+	if err != nil {
+		return 0, err
+	}
+	return f.cost(), nil
+}
+
+// decodeCost checks the header of an image against the decode limits and
+// returns need, how many bytes decoding it will take, if it fits.
+func decodeCost(path string, conf image.Config, need uint64) (uint64, error) {
+	pixels := uint64(conf.Width) * uint64(conf.Height)
+	if pixels > localConf.Decode.MaxPixels {
+		return 0, log.NewWarn("image too large: %s, %dx%d (%d pixels) exceeds decode.max_pixels %d",
+			path, conf.Width, conf.Height, pixels, localConf.Decode.MaxPixels)
+	}
+	cost := need
+	if cost > budget.total {
+		return 0, log.NewWarn("image too large: %s, %dx%d needs %d MB to decode, exceeds decode.memory_mb %d",
+			path, conf.Width, conf.Height, cost/megabyte, localConf.Decode.MemoryMB)
+	}
+	return cost, nil
+}
+
+// memBudget bounds the memory held by full-size decoded images across all
+// workers. A decode waits until its cost fits into what is left.
+type memBudget struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	total uint64
+	used  uint64
+}
+
+var budget = newMemBudget(defaultMemoryMB * megabyte)
+
+func newMemBudget(total uint64) *memBudget {
+	b := &memBudget{total: total}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+func (b *memBudget) acquire(n uint64) {
+	b.mutex.Lock()
+	for b.used+n > b.total {
+		b.cond.Wait()
+	}
+	b.used += n
+	b.mutex.Unlock()
+}
+
+func (b *memBudget) release(n uint64) {
+	b.mutex.Lock()
+	b.used -= n
+	b.mutex.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,76 @@
+package img
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// sof is a JPEG with nothing but a frame header of the given marker, size and
+// components, each an id and its sampling factors.
+func sof(marker byte, width, height int, comps ...[3]byte) []byte {
+	seg := []byte{8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), byte(len(comps))}
+	for _, c := range comps {
+		seg = append(seg, c[0], c[1]<<4|c[2], 0)
+	}
+	n := len(seg) + 2
+	return append([]byte{0xff, 0xd8, 0xff, marker, byte(n >> 8), byte(n)}, seg...)
+}
+
+func TestJPEGCost(t *testing.T) {
+	var ycc420 = [][3]byte{{1, 2, 2}, {2, 1, 1}, {3, 1, 1}}
+	var ycc444 = [][3]byte{{1, 1, 1}, {2, 1, 1}, {3, 1, 1}}
+	var tests = []struct {
+		name string
+		data []byte
+		want uint64
+	}{
+		{"gray", sof(0xc0, 1000, 1000, [3]byte{1, 1, 1}), 1000 * 1000},
+		{"gray padded", sof(0xc0, 10, 10, [3]byte{1, 1, 1}), 16 * 16},
+		{"baseline 4:2:0", sof(0xc0, 1600, 1200, ycc420...), 1600 * 1200 * 3 / 2},
+		{"baseline 4:4:4", sof(0xc0, 1600, 1200, ycc444...), 1600 * 1200 * 3},
+		{"progressive 4:2:0", sof(0xc2, 1600, 1200, ycc420...), 1600 * 1200 * 3 / 2 * 5},
+		{"progressive 4:4:4", sof(0xc2, 1600, 1200, ycc444...), 1600 * 1200 * 3 * 5},
+		{"rgb", sof(0xc0, 100, 100, [3]byte{'R', 1, 1}, [3]byte{'G', 1, 1}, [3]byte{'B', 1, 1}), 104*104*3 + 100*100*4},
+		{"cmyk", sof(0xc0, 100, 100, [3]byte{1, 1, 1}, [3]byte{2, 1, 1}, [3]byte{3, 1, 1}, [3]byte{4, 1, 1}), 104*104*4 + 100*100*4},
+	}
+	for _, tt := range tests {
+		got, err := jpegCost(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: cost %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJPEGCostEncoded(t *testing.T) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 640, 480)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := jpegCost(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(640 * 480 * 3 / 2); got != want {
+		t.Errorf("cost %d, want %d", got, want)
+	}
+}
+
+func TestJPEGCostInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		[]byte("\x89PNG\r\n"),
+		{0xff, 0xd8, 0xff, 0xda, 0, 2},
+		{0xff, 0xd8, 0xff, 0xc0, 0, 5, 8, 0, 1},
+	} {
+		if _, err := jpegCost(bytes.NewReader(data)); err == nil {
+			t.Errorf("%q: no error", data)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package img
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// camera reads the make and model of the camera from the EXIF of a JPEG, ""
+// when it has none. Only originals have it, archived copies are re-encoded.
+func camera(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+	x, err := exif.Decode(file)
+	if err != nil {
+		return ""
+	}
+	var parts []string
+	for _, name := range []exif.FieldName{exif.Make, exif.Model} {
+		tag, err := x.Get(name)
+		if err != nil {
+			continue
+		}
+		s, err := tag.StringVal()
+		if err == nil && strings.TrimSpace(s) != "" {
+			parts = append(parts, strings.TrimSpace(s))
+		}
+	}
+	return strings.Join(parts, " ")
+}
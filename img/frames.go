@@ -0,0 +1,309 @@
+package img
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+	"yangsi/log"
+)
+
+const (
+	defaultMaxFrames = 5
+	// frames whose hashes differ in no more bits than this count as the same
+	hashThreshold = 6
+	// video candidates extracted by ffmpeg for each frame we keep
+	videoCandidates = 4
+	ffmpegTimeout   = time.Minute * 2
+)
+
+var ffmpegPath string
+
+// loadGIF composites the frames of an animated GIF and keeps up to
+// frames.max of them that look different from each other.
+func loadGIF(path string) ([]image.Image, int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+	conf, err := gif.DecodeConfig(file)
+	if err != nil {
+		return nil, 0, 0, log.NewWarn("decode config failed: %s, %s", path, err.Error())
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	need, err := gifCost(file, conf)
+	if err != nil {
+		return nil, 0, 0, log.NewWarn("decode config failed: %s, %s", path, err.Error())
+	}
+	cost, err := decodeCost(path, conf, need)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	budget.acquire(cost)
+	defer budget.release(cost)
+	g, err := gif.DecodeAll(file)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	var hashes = make([]uint64, len(g.Image))
+	composeGIF(g, func(k int, canvas *image.RGBA) {
+		hashes[k] = aHash(canvas)
+	})
+	picked := distinct(hashes, localConf.Frames.Max)
+	var frames = make([]image.Image, 0, len(picked))
+	composeGIF(g, func(k int, canvas *image.RGBA) {
+		if len(frames) < len(picked) && picked[len(frames)] == k {
+			frames = append(frames, resize(clone(canvas), rzOption{
+				MaxPixel: localConf.OutImg.MaxPixel,
+			}))
+		}
+	})
+	log.RealtimeLog("%s: %d of %d frames kept", path, len(frames), len(g.Image))
+	return frames, conf.Width, conf.Height, nil
+}
+
+// gifCost is what loadGIF allocates for the GIF in r, conf being its header:
+// DecodeAll keeps a paletted frame of a byte a pixel for every frame, which
+// are counted by walking the blocks without decoding them, and composing
+// takes the RGBA canvas, its restore copy and a copy of it to downsample.
+func gifCost(r io.Reader, conf image.Config) (uint64, error) {
+	br := bufio.NewReader(r)
+	var head [13]byte
+	_, err := io.ReadFull(br, head[:])
+	if err != nil {
+		return 0, err
+	}
+	if string(head[:3]) != "GIF" {
+		return 0, errors.New("not a GIF")
+	}
+	if head[10]&0x80 != 0 {
+		err = skip(br, 3<<(head[10]&7+1))
+		if err != nil {
+			return 0, err
+		}
+	}
+	cost := 12 * uint64(conf.Width) * uint64(conf.Height)
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case 0x21:
+			// the label, then the data
+			err = skip(br, 1)
+		case 0x2c:
+			var desc [9]byte
+			_, err = io.ReadFull(br, desc[:])
+			if err != nil {
+				return 0, err
+			}
+			w := uint64(desc[4]) | uint64(desc[5])<<8
+			h := uint64(desc[6]) | uint64(desc[7])<<8
+			cost += w * h
+			if desc[8]&0x80 != 0 {
+				err = skip(br, 3<<(desc[8]&7+1))
+				if err != nil {
+					return 0, err
+				}
+			}
+			// the LZW code size, then the data
+			err = skip(br, 1)
+		case 0x3b:
+			return cost, nil
+		default:
+			return 0, fmt.Errorf("unknown block 0x%02x", c)
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = skipSubBlocks(br)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func skip(br *bufio.Reader, n int) error {
+	_, err := br.Discard(n)
+	return err
+}
+
+// skipSubBlocks skips data sub-blocks up to the empty one ending them.
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		n, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		err = skip(br, int(n))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// composeGIF plays the animation onto a white canvas, honouring the disposal
+// methods, and calls fn with the canvas after each frame is drawn.
+func composeGIF(g *gif.GIF, fn func(k int, canvas *image.RGBA)) {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, image.White, image.Point{}, draw.Src)
+	var previous *image.RGBA
+	for k, frame := range g.Image {
+		var disposal byte
+		if k < len(g.Disposal) {
+			disposal = g.Disposal[k]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = clone(canvas)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		fn(k, canvas)
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.White, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			draw.Draw(canvas, bounds, previous, image.Point{}, draw.Src)
+		}
+	}
+}
+
+// loadVideo lets ffmpeg pick the first frame and the scene changes of a video
+// and keeps up to frames.max of them that look different from each other.
+func loadVideo(path string) ([]image.Image, int, int, error) {
+	if ffmpegPath == "" {
+		return nil, 0, 0, log.NewWarn("ffmpeg not found, skip video: %s", path)
+	}
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ffmpegPath, "-v", "error", "-i", path,
+		"-vf", "select='eq(n,0)+gt(scene,0.2)'", "-vsync", "vfr",
+		"-frames:v", fmt.Sprint(localConf.Frames.Max*videoCandidates),
+		filepath.Join(dir, "%04d.png"))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, 0, 0, log.NewWarn("ffmpeg failed: %s, %s, %s", path, err.Error(), string(out))
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	sort.Strings(files)
+
+	// frames are decoded twice rather than all kept in memory while picking
+	var hashes = make([]uint64, 0, len(files))
+	var width, height int
+	for _, file := range files {
+		frame, w, h, err := loadStill(file)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		width, height = w, h
+		hashes = append(hashes, aHash(frame))
+	}
+	picked := distinct(hashes, localConf.Frames.Max)
+	var frames = make([]image.Image, 0, len(picked))
+	for _, k := range picked {
+		frame, _, _, err := loadStill(files[k])
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		frames = append(frames, frame)
+	}
+	log.RealtimeLog("%s: %d of %d frames kept", path, len(frames), len(files))
+	return frames, width, height, nil
+}
+
+func clone(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// aHash is the average hash of an image: one bit per cell of an 8x8 grid,
+// set when the cell is brighter than the mean.
+func aHash(img image.Image) uint64 {
+	const grid, samples = 8, 4
+	b := img.Bounds()
+	var lum [grid * grid]uint32
+	var sum uint32
+	for cy := 0; cy < grid; cy++ {
+		for cx := 0; cx < grid; cx++ {
+			var cell uint32
+			for sy := 0; sy < samples; sy++ {
+				for sx := 0; sx < samples; sx++ {
+					x := b.Min.X + (cx*samples+sx)*b.Dx()/(grid*samples)
+					y := b.Min.Y + (cy*samples+sy)*b.Dy()/(grid*samples)
+					cell += uint32(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+				}
+			}
+			lum[cy*grid+cx] = cell
+			sum += cell
+		}
+	}
+	mean := sum / (grid * grid)
+	var hash uint64
+	for k, v := range lum {
+		if v > mean {
+			hash |= 1 << uint(k)
+		}
+	}
+	return hash
+}
+
+// distinct returns the indexes of the frames that differ from every frame
+// kept before them, spread evenly down to max of them.
+func distinct(hashes []uint64, max int) []int {
+	var picked []int
+	for k, h := range hashes {
+		var same bool
+		for _, p := range picked {
+			if bits.OnesCount64(h^hashes[p]) <= hashThreshold {
+				same = true
+				break
+			}
+		}
+		if !same {
+			picked = append(picked, k)
+		}
+	}
+	if len(picked) <= max {
+		return picked
+	}
+	var result = make([]int, 0, max)
+	for k := 0; k < max; k++ {
+		result = append(result, picked[k*len(picked)/max])
+	}
+	return result
+}
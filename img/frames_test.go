@@ -0,0 +1,63 @@
+package img
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestGIFCost(t *testing.T) {
+	palette := color.Palette{color.White, color.Black}
+	var tests = []struct {
+		name   string
+		frames []image.Rectangle
+		local  bool
+	}{
+		{"one frame", []image.Rectangle{image.Rect(0, 0, 300, 200)}, false},
+		{"partial frames", []image.Rectangle{image.Rect(0, 0, 300, 200), image.Rect(10, 10, 60, 40), image.Rect(100, 0, 300, 50)}, false},
+		{"local palettes", []image.Rectangle{image.Rect(0, 0, 300, 200), image.Rect(0, 0, 300, 200)}, true},
+	}
+	for _, tt := range tests {
+		g := &gif.GIF{Config: image.Config{Width: 300, Height: 200, ColorModel: palette}}
+		want := uint64(12 * 300 * 200)
+		for k, r := range tt.frames {
+			p := palette
+			if tt.local && k > 0 {
+				p = color.Palette{color.Black, color.White, color.Gray{Y: 128}}
+			}
+			frame := image.NewPaletted(r, p)
+			frame.Pix[0] = 1
+			g.Image = append(g.Image, frame)
+			g.Delay = append(g.Delay, 10)
+			want += uint64(r.Dx() * r.Dy())
+		}
+		var buf bytes.Buffer
+		err := gif.EncodeAll(&buf, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := gifCost(bytes.NewReader(buf.Bytes()), g.Config)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: cost %d, want %d", tt.name, got, want)
+		}
+	}
+}
+
+func TestGIFCostTruncated(t *testing.T) {
+	g := &gif.GIF{Image: []*image.Paletted{image.NewPaletted(image.Rect(0, 0, 20, 20), color.Palette{color.White, color.Black})}, Delay: []int{0}}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()[:buf.Len()-1]
+	if _, err := gifCost(bytes.NewReader(data), image.Config{Width: 20, Height: 20}); err == nil {
+		t.Error("truncated GIF: no error")
+	}
+}
@@ -2,13 +2,18 @@ package img
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"image"
+	"image/draw"
 	"image/jpeg"
-	"image/png"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 	"yangsi/log"
@@ -20,15 +25,30 @@ const (
 	fmtPNG  = "png"
 	fmtJPG  = "jpg"
 	fmtJPEG = "jpeg"
+	fmtGIF  = "gif"
+	fmtMP4  = "mp4"
+	fmtMOV  = "mov"
 )
 
 type Image struct {
 	Dir      string
 	Basename string
 	Format   string
-	ModTime  string
+	ModTime  time.Time
+	// size in bytes and sha256 of the original file
+	Size   int64
+	SHA256 string
+	// make and model from the EXIF, "" without
+	Camera   string
+	Width    int
+	Height   int
 	Raw      image.Image
+	Frames   []image.Image
 	rawBytes []byte
+	// where the first frame sent to OCR starts in Raw, after the crop
+	ocrOrigin image.Point
+	// the original an archived copy was made of, for the crop rules
+	origPath string
 }
 
 func NewImage(dir string, filename string) (*Image, error) {
@@ -49,19 +69,87 @@ func NewImage(dir string, filename string) (*Image, error) {
 		Dir:      dir,
 		Basename: string(filename[:index]),
 		Format:   format,
-		ModTime:  stat.ModTime().Format("2006-01-02 15:04:05"),
+		ModTime:  stat.ModTime(),
+		Size:     stat.Size(),
 	}, nil
 }
 
+// AsOriginal makes the crop rules take a loaded archived copy for the
+// original at origPath it was made of, width by height, as its record tells.
+func (i *Image) AsOriginal(origPath string, width, height int) {
+	i.origPath = origPath
+	if width > 0 && height > 0 {
+		i.Width, i.Height = width, height
+	}
+}
+
 func (i *Image) Path() string {
 	return fmt.Sprintf("%s/%s.%s", i.Dir, i.Basename, i.Format)
 }
 
-func (i *Image) Load() (err error) {
-	i.Raw, err = load(i.Path(), i.Format)
-	return
+func (i *Image) Filename() string {
+	return fmt.Sprintf("%s.%s", i.Basename, i.Format)
+}
+
+// Hash reads the sha256 of the original, which Load does unless it was.
+func (i *Image) Hash() error {
+	file, err := os.Open(i.Path())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return log.NewWarn("hash failed: %s, %s", i.Path(), err.Error())
+	}
+	i.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return nil
+}
+
+// Load decodes the image, or the frames of an animated GIF or video, within
+// the decode limits. Everything is downsampled to out_img.max_pixel before its
+// share of the memory budget is given back, so a full-size bitmap never
+// outlives the decode.
+func (i *Image) Load() error {
+	var err error
+	if i.SHA256 == "" {
+		err = i.Hash()
+		if err != nil {
+			return err
+		}
+	}
+	switch i.Format {
+	case fmtJPG, fmtJPEG:
+		i.Camera = camera(i.Path())
+	}
+	switch i.Format {
+	case fmtGIF:
+		i.Frames, i.Width, i.Height, err = loadGIF(i.Path())
+	case fmtMP4, fmtMOV:
+		i.Frames, i.Width, i.Height, err = loadVideo(i.Path())
+	default:
+		var raw image.Image
+		raw, i.Width, i.Height, err = loadStill(i.Path())
+		if err == nil {
+			i.Frames = []image.Image{raw}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(i.Frames) == 0 {
+		return log.NewWarn("no frame decoded: %s", i.Path())
+	}
+	i.Raw = i.Frames[0]
+	return nil
 }
 
+// TempSuffix marks an archived copy whose record isn't committed yet.
+const TempSuffix = ".tmp"
+
+// Store writes the archived copy to path plus TempSuffix, to be renamed to
+// path once its record is committed.
 func (i *Image) Store() (string, error) {
 	var err error
 	if len(i.rawBytes) == 0 {
@@ -70,14 +158,28 @@ func (i *Image) Store() (string, error) {
 			return "", err
 		}
 	}
-	var path = fmt.Sprintf("%s/%s_o.%s", nowOutDir, i.Basename, i.Format)
-	err = ioutil.WriteFile(path, i.rawBytes, os.ModePerm)
+	dir, err := dayDir()
+	if err != nil {
+		return "", err
+	}
+	var path = fmt.Sprintf("%s/%s_o.%s", dir, i.Basename, i.outFormat())
+	err = ioutil.WriteFile(path+TempSuffix, i.rawBytes, os.ModePerm)
 	if err != nil {
 		return "", err
 	}
 	return path, nil
 }
 
+// outFormat is the extension of the archived copy; animations and videos are
+// archived as their first frame.
+func (i *Image) outFormat() string {
+	switch i.Format {
+	case fmtJPEG, fmtJPG, fmtPNG:
+		return i.Format
+	}
+	return fmtJPG
+}
+
 func (i *Image) Compress() ([]byte, error) {
 	var err error
 	i.rawBytes, err = compress(i.Raw, &jpeg.Options{
@@ -92,36 +194,73 @@ func (i *Image) Resize() {
 	})
 }
 
-func (i *Image) Smaller() ([]byte, error) {
+// Smaller downsamples and compresses the image for archiving and returns one
+// copy per frame to send to OCR, each with the matching crop rule applied.
+func (i *Image) Smaller() ([][]byte, error) {
 	i.Resize()
-	return i.Compress()
+	i.Frames[0] = i.Raw
+	_, err := i.Compress()
+	if err != nil {
+		return nil, err
+	}
+	rule := matchCrop(i)
+	var result = make([][]byte, 0, len(i.Frames))
+	for k, frame := range i.Frames {
+		if rule != nil {
+			rect := rule.rect(frame.Bounds(), i.Width, i.Height)
+			if rect.Empty() {
+				return nil, log.NewWarn("crop rule leaves nothing: %s, %+v", i.Path(), *rule)
+			}
+			frame = crop(frame, rect)
+		}
+		if k == 0 {
+			i.ocrOrigin = frame.Bounds().Min
+		}
+		data, err := compress(frame, &jpeg.Options{
+			Quality: localConf.OutImg.Quality,
+		})
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, data)
+	}
+	return result, nil
 }
 
-func varifyFormat(format string) error {
-	switch format {
-	case fmtJPEG, fmtJPG, fmtPNG:
+// redactMargin is the pixels blacked out around each box, for the edges of
+// the characters OCR leaves out.
+const redactMargin = 2
+
+// Redact blacks out boxes of the first frame as it was sent to OCR in the
+// archived copy, which Store writes then.
+func (i *Image) Redact(boxes []image.Rectangle) error {
+	if len(boxes) == 0 {
 		return nil
 	}
-	return log.NewError("invalid image format: %s", format)
+	b := i.Raw.Bounds()
+	canvas := image.NewRGBA(b)
+	draw.Draw(canvas, b, i.Raw, b.Min, draw.Src)
+	for _, box := range boxes {
+		box = box.Add(i.ocrOrigin).Inset(-redactMargin).Intersect(b)
+		draw.Draw(canvas, box, image.Black, image.Point{}, draw.Src)
+	}
+	i.Raw = canvas
+	i.Frames[0] = canvas
+	_, err := i.Compress()
+	return err
 }
 
-func load(path, format string) (image.Image, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-	var img image.Image
+func varifyFormat(format string) error {
 	switch format {
-	case fmtJPEG, fmtJPG:
-		img, err = jpeg.Decode(file)
-	case fmtPNG:
-		img, err = png.Decode(file)
-	}
-	if err != nil {
-		return nil, err
+	case fmtJPEG, fmtJPG, fmtPNG, fmtGIF:
+		return nil
+	case fmtMP4, fmtMOV:
+		if ffmpegPath == "" {
+			return log.NewWarn("ffmpeg not found, skip video format: %s", format)
+		}
+		return nil
 	}
-	return img, nil
+	return log.NewError("invalid image format: %s", format)
 }
 
 type rzOption struct {
@@ -171,6 +310,30 @@ type config struct {
 		MaxPixel uint `json:"max_pixel"`
 		Quality  int  `json:"quality"`
 	} `json:"out_img"`
+	Decode struct {
+		MaxPixels uint64 `json:"max_pixels"`
+		MemoryMB  uint64 `json:"memory_mb"`
+	} `json:"decode"`
+	Crop   []cropRule `json:"crop"`
+	Frames struct {
+		Max    int    `json:"max"`
+		FFmpeg string `json:"ffmpeg"`
+	} `json:"frames"`
+}
+
+func (c *config) setDefault() {
+	if c.Decode.MaxPixels == 0 {
+		c.Decode.MaxPixels = defaultMaxPixels
+	}
+	if c.Decode.MemoryMB == 0 {
+		c.Decode.MemoryMB = defaultMemoryMB
+	}
+	if c.Frames.Max == 0 {
+		c.Frames.Max = defaultMaxFrames
+	}
+	if c.Frames.FFmpeg == "" {
+		c.Frames.FFmpeg = "ffmpeg"
+	}
 }
 
 func (c *config) check() error {
@@ -178,34 +341,60 @@ func (c *config) check() error {
 		c.OutImg.Quality == 0 || c.OutImg.Quality > 100 {
 		return log.NewError("invalid img config: %+v", *c)
 	}
+	for k := range c.Crop {
+		if err := c.Crop[k].check(); err != nil {
+			return err
+		}
+	}
 	return nil
 
 }
 
 var (
 	localConf config
-	nowOutDir string
+	// the root dir originals are found in, which crop globs are relative to
+	root string
 )
 
-func Init(str json.RawMessage) error {
+// OutDir is where the archived copies go, in a dir per day.
+func OutDir() string {
+	return localConf.OutDir
+}
+
+// Init loads the config; rootDir is the dir originals are found in.
+func Init(str json.RawMessage, rootDir string) error {
+	root = filepath.Clean(filepath.FromSlash(rootDir))
 	err := json.Unmarshal(str, &localConf)
 	if err != nil {
 		return log.NewError("unmarshal img config failed: %s, %s", err.Error(), string(str))
 	}
+	localConf.setDefault()
 	err = localConf.check()
 	if err != nil {
 		return err
 	}
-	nowOutDir = fmt.Sprintf("%s/%s", localConf.OutDir, time.Now().Format("20060102"))
-	_, err = os.Stat(nowOutDir)
+	budget = newMemBudget(localConf.Decode.MemoryMB * megabyte)
+	ffmpegPath, err = exec.LookPath(localConf.Frames.FFmpeg)
+	if err != nil {
+		log.WarnLog("ffmpeg not found, videos will be skipped: %s", err.Error())
+	}
+	_, err = dayDir()
+	return err
+}
+
+// dayDir is the dir of today in OutDir, made if it isn't there yet. It is
+// told on every Store, which watch keeps doing for days.
+func dayDir() (string, error) {
+	dir := fmt.Sprintf("%s/%s", localConf.OutDir, time.Now().Format("20060102"))
+	_, err := os.Stat(dir)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			return log.NewError("out dir failed: %s, %s", nowOutDir, err.Error())
+			return "", log.NewError("out dir failed: %s, %s", dir, err.Error())
 		}
-		err = os.MkdirAll(nowOutDir, os.ModePerm)
+		err = os.MkdirAll(dir, os.ModePerm)
 		if err != nil {
-			return log.NewError("mkdir failed: %s, %s", nowOutDir, err.Error())
+			return "", log.NewError("mkdir failed: %s, %s", dir, err.Error())
 		}
 	}
-	return nil
+	return dir, nil
 }
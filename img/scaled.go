@@ -0,0 +1,558 @@
+package img
+
+import (
+	"bufio"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// A JPEG too large to decode in full is decoded at 1/8 of its size: the DC
+// coefficient of an 8x8 block is 8 times the mean of its samples, so the
+// DC coefficients alone give one pixel a block, which is what libjpeg's
+// scale_denom 8 does. The AC coefficients are Huffman decoded only to be
+// skipped, and the AC scans of progressive JPEGs skipped altogether, so that
+// nothing but one int32 a block is kept. Baseline, extended and progressive
+// Huffman-coded 8-bit JPEGs are supported, which is what cameras and phones
+// write.
+
+type huffTable struct {
+	maxCode [17]int32
+	minCode [17]int32
+	valPtr  [17]int32
+	vals    []byte
+	defined bool
+}
+
+type scaledComp struct {
+	id     byte
+	h, v   int
+	tq     byte
+	td, ta byte
+	pred   int32
+	// DC coefficient of every block of the component's plane
+	dc     []int32
+	stride int
+}
+
+type scaledDecoder struct {
+	r       *bufio.Reader
+	acc     uint32
+	nbits   uint
+	marker  byte
+	quant   [4]int32
+	dcTab   [4]huffTable
+	acTab   [4]huffTable
+	restart int
+
+	frame       bool
+	scans       int
+	width       int
+	height      int
+	progressive bool
+	comps       []scaledComp
+	hMax, vMax  int
+	mcusX       int
+	mcusY       int
+
+	jfif       bool
+	adobe      bool
+	adobeXform byte
+}
+
+var errTruncated = errors.New("truncated JPEG")
+
+// decodeScaled decodes the JPEG in r at 1/8 of its size, rounded up.
+func decodeScaled(r io.Reader) (image.Image, error) {
+	d := &scaledDecoder{r: bufio.NewReaderSize(r, 64*1024)}
+	var soi [2]byte
+	_, err := io.ReadFull(d.r, soi[:])
+	if err != nil {
+		return nil, err
+	}
+	if soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, errors.New("missing SOI marker")
+	}
+	for {
+		marker, err := d.nextMarker()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case marker == 0xd9:
+			return d.image()
+		case marker == 0x01 || marker == 0xd8 || marker >= 0xd0 && marker <= 0xd7:
+			continue
+		}
+		var size [2]byte
+		_, err = io.ReadFull(d.r, size[:])
+		if err != nil {
+			return nil, err
+		}
+		n := int(size[0])<<8 | int(size[1]) - 2
+		if n < 0 {
+			return nil, errors.New("invalid segment length")
+		}
+		seg := make([]byte, n)
+		_, err = io.ReadFull(d.r, seg)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case marker == 0xc0 || marker == 0xc1 || marker == 0xc2:
+			err = d.readFrame(seg, marker == 0xc2)
+		case marker >= 0xc3 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc:
+			err = errors.New("unsupported JPEG process")
+		case marker == 0xc4:
+			err = d.readHuffman(seg)
+		case marker == 0xdb:
+			err = d.readQuant(seg)
+		case marker == 0xdd:
+			if n < 2 {
+				err = errors.New("invalid DRI segment")
+			} else {
+				d.restart = int(seg[0])<<8 | int(seg[1])
+			}
+		case marker == 0xe0:
+			d.jfif = n >= 5 && string(seg[:5]) == "JFIF\x00"
+		case marker == 0xee:
+			if n >= 12 && string(seg[:5]) == "Adobe" {
+				d.adobe, d.adobeXform = true, seg[11]
+			}
+		case marker == 0xda:
+			err = d.readScan(seg)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextMarker returns the marker the entropy-coded data stopped at, or else
+// skips to the next one.
+func (d *scaledDecoder) nextMarker() (byte, error) {
+	if d.marker != 0 {
+		m := d.marker
+		d.marker = 0
+		return m, nil
+	}
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xff {
+			continue
+		}
+		for b == 0xff {
+			b, err = d.r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+		}
+		// stuffed bytes and restarts are part of the data skipped
+		if b != 0 && (b < 0xd0 || b > 0xd7) {
+			return b, nil
+		}
+	}
+}
+
+func (d *scaledDecoder) readFrame(seg []byte, progressive bool) error {
+	if d.frame {
+		return errors.New("more than one frame")
+	}
+	if len(seg) < 6 || seg[0] != 8 {
+		return errors.New("unsupported JPEG precision")
+	}
+	nc := int(seg[5])
+	if nc != 1 && nc != 3 && nc != 4 || len(seg) < 6+3*nc {
+		return errors.New("invalid frame header")
+	}
+	d.frame = true
+	d.progressive = progressive
+	d.height = int(seg[1])<<8 | int(seg[2])
+	d.width = int(seg[3])<<8 | int(seg[4])
+	if d.width == 0 || d.height == 0 {
+		return errors.New("unsupported image size")
+	}
+	d.hMax, d.vMax = 1, 1
+	d.comps = make([]scaledComp, nc)
+	for k := range d.comps {
+		c := &d.comps[k]
+		c.id = seg[6+3*k]
+		c.h, c.v = int(seg[7+3*k]>>4), int(seg[7+3*k]&0x0f)
+		c.tq = seg[8+3*k]
+		if c.h < 1 || c.h > 4 || c.v < 1 || c.v > 4 || c.tq > 3 {
+			return errors.New("invalid frame header")
+		}
+		if c.h > d.hMax {
+			d.hMax = c.h
+		}
+		if c.v > d.vMax {
+			d.vMax = c.v
+		}
+	}
+	d.mcusX = (d.width + 8*d.hMax - 1) / (8 * d.hMax)
+	d.mcusY = (d.height + 8*d.vMax - 1) / (8 * d.vMax)
+	for k := range d.comps {
+		c := &d.comps[k]
+		c.stride = d.mcusX * c.h
+		c.dc = make([]int32, c.stride*d.mcusY*c.v)
+	}
+	return nil
+}
+
+func (d *scaledDecoder) readHuffman(seg []byte) error {
+	for len(seg) > 0 {
+		if len(seg) < 17 || seg[0]>>4 > 1 || seg[0]&0x0f > 3 {
+			return errors.New("invalid DHT segment")
+		}
+		t := &d.dcTab[seg[0]&0x0f]
+		if seg[0]>>4 == 1 {
+			t = &d.acTab[seg[0]&0x0f]
+		}
+		counts := seg[1:17]
+		var total int
+		for _, n := range counts {
+			total += int(n)
+		}
+		if total > 256 || len(seg) < 17+total {
+			return errors.New("invalid DHT segment")
+		}
+		t.vals = append([]byte(nil), seg[17:17+total]...)
+		var code, k int32
+		for l := 1; l <= 16; l++ {
+			n := int32(counts[l-1])
+			t.valPtr[l] = k
+			t.minCode[l] = code
+			t.maxCode[l] = -1
+			if n > 0 {
+				t.maxCode[l] = code + n - 1
+			}
+			code = (code + n) << 1
+			k += n
+		}
+		t.defined = true
+		seg = seg[17+total:]
+	}
+	return nil
+}
+
+// readQuant keeps the first, DC entry of every quantization table.
+func (d *scaledDecoder) readQuant(seg []byte) error {
+	for len(seg) > 0 {
+		tq := seg[0] & 0x0f
+		if tq > 3 {
+			return errors.New("invalid DQT segment")
+		}
+		switch seg[0] >> 4 {
+		case 0:
+			if len(seg) < 65 {
+				return errors.New("invalid DQT segment")
+			}
+			d.quant[tq] = int32(seg[1])
+			seg = seg[65:]
+		case 1:
+			if len(seg) < 129 {
+				return errors.New("invalid DQT segment")
+			}
+			d.quant[tq] = int32(seg[1])<<8 | int32(seg[2])
+			seg = seg[129:]
+		default:
+			return errors.New("invalid DQT segment")
+		}
+	}
+	return nil
+}
+
+// readBit returns the next bit of the entropy-coded data, zeros once a
+// marker is hit.
+func (d *scaledDecoder) readBit() (int32, error) {
+	if d.nbits == 0 {
+		d.acc, d.nbits = 0, 8
+		if d.marker != 0 {
+			return 0, nil
+		}
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return 0, errTruncated
+		}
+		if b == 0xff {
+			b, err = d.r.ReadByte()
+			for err == nil && b == 0xff {
+				b, err = d.r.ReadByte()
+			}
+			if err != nil {
+				return 0, errTruncated
+			}
+			if b == 0 {
+				b = 0xff
+			} else {
+				d.marker, b = b, 0
+			}
+		}
+		d.acc = uint32(b)
+	}
+	d.nbits--
+	return int32(d.acc>>d.nbits) & 1, nil
+}
+
+func (d *scaledDecoder) readBits(n byte) (int32, error) {
+	var v int32
+	for k := byte(0); k < n; k++ {
+		b, err := d.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (d *scaledDecoder) decodeHuffman(t *huffTable) (byte, error) {
+	var code int32
+	for l := 1; l <= 16; l++ {
+		b, err := d.readBit()
+		if err != nil {
+			return 0, err
+		}
+		code = code<<1 | b
+		if code <= t.maxCode[l] {
+			return t.vals[t.valPtr[l]+code-t.minCode[l]], nil
+		}
+	}
+	return 0, errors.New("invalid Huffman code")
+}
+
+// receiveExtend reads a coefficient of s bits.
+func (d *scaledDecoder) receiveExtend(s byte) (int32, error) {
+	if s == 0 {
+		return 0, nil
+	}
+	if s > 16 {
+		return 0, errors.New("invalid coefficient size")
+	}
+	v, err := d.readBits(s)
+	if err != nil {
+		return 0, err
+	}
+	if v < 1<<(s-1) {
+		v += -1<<s + 1
+	}
+	return v, nil
+}
+
+func (d *scaledDecoder) readScan(seg []byte) error {
+	if !d.frame {
+		return errors.New("scan before frame header")
+	}
+	if len(seg) < 1 {
+		return errors.New("invalid SOS segment")
+	}
+	ns := int(seg[0])
+	if ns < 1 || ns > len(d.comps) || len(seg) < 4+2*ns {
+		return errors.New("invalid SOS segment")
+	}
+	var comps []*scaledComp
+	for k := 0; k < ns; k++ {
+		id, tables := seg[1+2*k], seg[2+2*k]
+		var c *scaledComp
+		for m := range d.comps {
+			if d.comps[m].id == id {
+				c = &d.comps[m]
+			}
+		}
+		if c == nil || tables>>4 > 3 || tables&0x0f > 3 {
+			return errors.New("invalid SOS segment")
+		}
+		c.td, c.ta = tables>>4, tables&0x0f
+		c.pred = 0
+		comps = append(comps, c)
+	}
+	ss, ah, al := seg[1+2*ns], seg[3+2*ns]>>4, seg[3+2*ns]&0x0f
+	d.scans++
+	if d.progressive && ss > 0 {
+		// AC scans are skipped with the data up to the next marker
+		return nil
+	}
+	d.acc, d.nbits, d.marker = 0, 0, 0
+
+	block := func(c *scaledComp, at int) error {
+		if d.progressive && ah > 0 {
+			b, err := d.readBit()
+			if err == nil && b == 1 {
+				c.dc[at] |= 1 << al
+			}
+			return err
+		}
+		t := &d.dcTab[c.td]
+		if !t.defined {
+			return errors.New("missing Huffman table")
+		}
+		s, err := d.decodeHuffman(t)
+		if err != nil {
+			return err
+		}
+		diff, err := d.receiveExtend(s)
+		if err != nil {
+			return err
+		}
+		c.pred += diff
+		c.dc[at] = c.pred << al
+		if d.progressive {
+			return nil
+		}
+		t = &d.acTab[c.ta]
+		if !t.defined {
+			return errors.New("missing Huffman table")
+		}
+		for k := 1; k < 64; k++ {
+			rs, err := d.decodeHuffman(t)
+			if err != nil {
+				return err
+			}
+			r, s := int(rs>>4), rs&0x0f
+			if s == 0 {
+				if r != 15 {
+					break
+				}
+				k += 15
+				continue
+			}
+			k += r
+			_, err = d.readBits(s)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// a scan of one component has its blocks in rows of the component's own
+	// width rather than in MCUs
+	var mcus, mcusX int
+	if ns == 1 {
+		c := comps[0]
+		mcusX = ((d.width*c.h+d.hMax-1)/d.hMax + 7) / 8
+		mcus = mcusX * (((d.height*c.v+d.vMax-1)/d.vMax + 7) / 8)
+	} else {
+		mcusX = d.mcusX
+		mcus = d.mcusX * d.mcusY
+	}
+	for n := 0; n < mcus; n++ {
+		mx, my := n%mcusX, n/mcusX
+		if ns == 1 {
+			c := comps[0]
+			err := block(c, my*c.stride+mx)
+			if err != nil {
+				return err
+			}
+		} else {
+			for _, c := range comps {
+				for v := 0; v < c.v; v++ {
+					for h := 0; h < c.h; h++ {
+						err := block(c, (my*c.v+v)*c.stride+mx*c.h+h)
+						if err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+		if d.restart > 0 && (n+1)%d.restart == 0 && n+1 < mcus {
+			err := d.resync()
+			if err != nil {
+				return err
+			}
+			for _, c := range comps {
+				c.pred = 0
+			}
+		}
+	}
+	return nil
+}
+
+// resync moves past the restart marker that ends an interval.
+func (d *scaledDecoder) resync() error {
+	d.acc, d.nbits = 0, 0
+	marker := d.marker
+	d.marker = 0
+	for marker == 0 {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return errTruncated
+		}
+		for b == 0xff {
+			b, err = d.r.ReadByte()
+			if err != nil {
+				return errTruncated
+			}
+			if b != 0xff && b != 0 {
+				marker = b
+			}
+		}
+	}
+	if marker < 0xd0 || marker > 0xd7 {
+		return errors.New("missing restart marker")
+	}
+	return nil
+}
+
+// image converts the DC coefficients to pixels, the way image/jpeg converts
+// the colors of the full-size image.
+func (d *scaledDecoder) image() (image.Image, error) {
+	if !d.frame || d.scans == 0 {
+		return nil, errors.New("missing SOS marker")
+	}
+	w, h := (d.width+7)/8, (d.height+7)/8
+	sample := func(c *scaledComp, x, y int) uint8 {
+		v := c.dc[(y*c.v/d.vMax)*c.stride+x*c.h/d.hMax]*d.quant[c.tq]/8 + 128
+		if v < 0 {
+			return 0
+		}
+		if v > 255 {
+			return 255
+		}
+		return uint8(v)
+	}
+	if len(d.comps) == 1 {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.Pix[y*img.Stride+x] = sample(&d.comps[0], x, y)
+			}
+		}
+		return img, nil
+	}
+	if len(d.comps) == 4 && !d.adobe {
+		return nil, errors.New("unknown color model: 4-component JPEG doesn't have Adobe APP14 metadata")
+	}
+	rgb := !d.jfif && (d.adobe && d.adobeXform == 0 ||
+		d.comps[0].id == 'R' && d.comps[1].id == 'G' && d.comps[2].id == 'B')
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c0, c1, c2 := sample(&d.comps[0], x, y), sample(&d.comps[1], x, y), sample(&d.comps[2], x, y)
+			var r, g, b uint8
+			switch {
+			case len(d.comps) == 4:
+				// Adobe CMYK is inverted, which converting YCbCr to RGB undoes
+				k := sample(&d.comps[3], x, y)
+				if d.adobeXform != 0 {
+					c0, c1, c2 = color.YCbCrToRGB(c0, c1, c2)
+				} else {
+					c0, c1, c2 = 255-c0, 255-c1, 255-c2
+				}
+				r, g, b = color.CMYKToRGB(c0, c1, c2, 255-k)
+			case rgb:
+				r, g, b = c0, c1, c2
+			default:
+				r, g, b = color.YCbCrToRGB(c0, c1, c2)
+			}
+			i := y*img.Stride + 4*x
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = r, g, b, 0xff
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,167 @@
+package img
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tiles is an image of 16x16 tiles of different colors.
+func tiles(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			tx, ty := x/16, y/16
+			img.Set(x, y, color.RGBA{uint8(tx * 37), uint8(ty * 53), uint8((tx + ty) * 29), 0xff})
+		}
+	}
+	return img
+}
+
+// blockMeans is the mean of every 8x8 block of img, an image 1/8 of its size.
+func blockMeans(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, (b.Dx()+7)/8, (b.Dy()+7)/8))
+	for by := 0; by < out.Rect.Dy(); by++ {
+		for bx := 0; bx < out.Rect.Dx(); bx++ {
+			var sum [3]uint32
+			var n uint32
+			for y := b.Min.Y + 8*by; y < b.Min.Y+8*by+8 && y < b.Max.Y; y++ {
+				for x := b.Min.X + 8*bx; x < b.Min.X+8*bx+8 && x < b.Max.X; x++ {
+					r, g, b, _ := img.At(x, y).RGBA()
+					sum[0], sum[1], sum[2] = sum[0]+r>>8, sum[1]+g>>8, sum[2]+b>>8
+					n++
+				}
+			}
+			out.Set(bx, by, color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), 0xff})
+		}
+	}
+	return out
+}
+
+func TestDecodeScaled(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 100, 60))
+	for k := range gray.Pix {
+		gray.Pix[k] = uint8(k % 100 * 2)
+	}
+	var tests = []struct {
+		name string
+		img  image.Image
+		// or the JPEG, written by libjpeg
+		file string
+	}{
+		{name: "ycbcr 4:2:0", img: tiles(200, 120)},
+		{name: "odd size", img: tiles(203, 117)},
+		{name: "gray", img: gray},
+		{name: "restart intervals", file: "restart.jpg"},
+		{name: "progressive with successive approximation", file: "progressive.jpg"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if tt.file != "" {
+			data, err := ioutil.ReadFile(filepath.Join("testdata", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf.Write(data)
+		} else {
+			err := jpeg.Encode(&buf, tt.img, &jpeg.Options{Quality: 95})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		full, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := blockMeans(full)
+		got, err := decodeScaled(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.Bounds() != want.Bounds() {
+			t.Errorf("%s: bounds %v, want %v", tt.name, got.Bounds(), want.Bounds())
+			continue
+		}
+		var worst int
+		for y := 0; y < want.Rect.Dy(); y++ {
+			for x := 0; x < want.Rect.Dx(); x++ {
+				r0, g0, b0, _ := got.At(x, y).RGBA()
+				r1, g1, b1, _ := want.At(x, y).RGBA()
+				for _, d := range []int{int(r0>>8) - int(r1>>8), int(g0>>8) - int(g1>>8), int(b0>>8) - int(b1>>8)} {
+					if d < 0 {
+						d = -d
+					}
+					if d > worst {
+						worst = d
+					}
+				}
+			}
+		}
+		if worst > 4 {
+			t.Errorf("%s: a pixel off by %d from the mean of its block", tt.name, worst)
+		}
+	}
+}
+
+func TestDecodeScaledInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, tiles(64, 64), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for name, data := range map[string][]byte{
+		"empty":     nil,
+		"png":       []byte("\x89PNG\r\n\x1a\n"),
+		"truncated": data[:len(data)/2],
+	} {
+		if _, err := decodeScaled(bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestLoadStillScaled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.jpg")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = jpeg.Encode(f, tiles(400, 240), nil)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := localConf
+	defer func() { localConf = saved }()
+	localConf.OutImg.MaxPixel = 1000 * 1000
+	localConf.Decode.MaxPixels = 10000
+
+	img, w, h, err := loadStill(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != 400 || h != 240 || img.Bounds().Dx() != 50 || img.Bounds().Dy() != 30 {
+		t.Errorf("%dx%d decoded as %v, want 400x240 decoded at 50x30", w, h, img.Bounds())
+	}
+
+	localConf.Decode.MaxPixels = 1000
+	_, _, _, err = loadStill(path)
+	if err == nil || !strings.Contains(err.Error(), "decode.max_pixels 1000") {
+		t.Errorf("too large at 1/8 too: %v, want the limit named", err)
+	}
+}
@@ -0,0 +1,34 @@
+package img
+
+import (
+	"image"
+	"image/jpeg"
+	"os"
+	"yangsi/log"
+
+	rz "github.com/nfnt/resize"
+)
+
+const thumbQuality = 70
+
+// Thumbnail returns a JPEG of an archived copy no larger than maxPixel on
+// either side. Archived copies are already downsampled, so it needs no Init
+// and skips the decode limits.
+func Thumbnail(path string, maxPixel uint) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	// by the contents, the copy of a PNG being JPEG too
+	raw, _, err := image.Decode(file)
+	if err != nil {
+		return nil, log.NewWarn("decode failed: %s, %s", path, err.Error())
+	}
+	return compress(resize(raw, rzOption{
+		Func:     rz.Bilinear,
+		MaxPixel: maxPixel,
+	}), &jpeg.Options{
+		Quality: thumbQuality,
+	})
+}
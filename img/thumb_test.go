@@ -0,0 +1,41 @@
+package img
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Archived copies of PNGs are named .png but hold JPEG.
+func TestThumbnailJPEGNamedPNG(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 800, 400)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "a_o.png")
+	err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Thumbnail(path, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Width != 200 || conf.Height != 100 {
+		t.Errorf("thumbnail %dx%d, want 200x100", conf.Width, conf.Height)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"yangsi/db"
+	"yangsi/entity"
+	"yangsi/img"
+	"yangsi/log"
+)
+
+// importer merges the rows of another database into ours. Archived copies
+// are looked up below the other out dir by their day dir and name, as the
+// paths in the other database are those of the other machine.
+type importer struct {
+	outDir string
+	// hashes of our archived copies, for rows on either side from before the
+	// hash of the original was stored; built when first needed
+	copies map[string]bool
+
+	imported, duplicates, failed int
+}
+
+func importDB(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	outDir := fs.String("out-dir", "", "out dir of the other database, where its archived images are")
+	tbName := fs.String("tb-name", "yangsi", "table of the other database")
+	rest, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 || *outDir == "" {
+		return log.NewError("usage: import -out-dir <dir> <other.db>")
+	}
+	src, err := db.OpenSource(rest[0], *tbName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	im := &importer{outDir: *outDir}
+	err = src.Each(context.Background(), im.merge)
+	log.InfoLog("imported %d, skipped %d duplicates, %d failed", im.imported, im.duplicates, im.failed)
+	return err
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sourcePath finds the archived copy of a row of the other database and the
+// day dir it is in, which is "" for copies archived before there were any.
+func (im *importer) sourcePath(path string) (string, string) {
+	path = transformPath(path)
+	name := filepath.Base(path)
+	day := filepath.Base(filepath.Dir(path))
+	src := filepath.Join(im.outDir, day, name)
+	if _, err := os.Stat(src); err != nil {
+		return filepath.Join(im.outDir, name), ""
+	}
+	return src, day
+}
+
+// duplicate tells whether r is in our database already: by the hash of its
+// original when it has one, then by the hash of its archived copy, as our row
+// of it may have none.
+func (im *importer) duplicate(r *db.Record, copyHash string) (bool, error) {
+	if r.SHA256 != "" {
+		dup, err := db.HasSHA256(r.SHA256)
+		if err != nil || dup {
+			return dup, err
+		}
+	}
+	if im.copies == nil {
+		im.copies = make(map[string]bool)
+		err := db.Each(context.Background(), &db.Filter{}, func(local *db.Record) error {
+			if h, err := fileSHA256(local.Path); err == nil {
+				im.copies[h] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return im.copies[copyHash], nil
+}
+
+// target picks a name for the copy in our out dir that isn't taken yet.
+func target(day, name string) (string, error) {
+	dir := img.OutDir()
+	if day != "" {
+		dir = fmt.Sprintf("%s/%s", dir, day)
+	}
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	path := fmt.Sprintf("%s/%s", dir, name)
+	for n := 1; ; n++ {
+		_, err = os.Stat(path)
+		if os.IsNotExist(err) {
+			return path, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		path = fmt.Sprintf("%s/%s_%d%s", dir, base, n, ext)
+	}
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// O_EXCL as another import could have taken the name meanwhile
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// merge imports one row. A row that can't be is logged and skipped, so that
+// one missing image doesn't stop the import.
+func (im *importer) merge(r *db.SourceRow) error {
+	err := im.mergeRow(r)
+	if err != nil {
+		log.WriteError(err, "import %d failed", r.ID)
+		im.failed++
+	}
+	return nil
+}
+
+func (im *importer) mergeRow(row *db.SourceRow) error {
+	r := &row.Record
+	src, day := im.sourcePath(r.Path)
+	copyHash, err := fileSHA256(src)
+	if err != nil {
+		return log.NewWarn("archived image not found: %s, %s", src, err.Error())
+	}
+	dup, err := im.duplicate(r, copyHash)
+	if err != nil {
+		return err
+	}
+	if dup {
+		im.duplicates++
+		return nil
+	}
+	dst, err := target(day, filepath.Base(src))
+	if err != nil {
+		return err
+	}
+	err = copyFile(dst, src)
+	if err != nil {
+		return log.NewError("copy %s failed: %s", src, err.Error())
+	}
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			os.Remove(dst)
+		}
+	}()
+	r.Path = dst
+	_, err = db.Insert(tx, r)
+	if err != nil {
+		return err
+	}
+	for _, code := range row.Codes {
+		err = db.InsertCode(tx, r.ID, code.Format, code.Payload)
+		if err != nil {
+			return err
+		}
+	}
+	if len(row.Tags) > 0 {
+		err = db.AddTags(tx, r.ID, row.Tags...)
+		if err != nil {
+			return err
+		}
+	}
+	if len(row.AutoTags) > 0 {
+		err = db.SetAutoTags(tx, r.ID, row.AutoTags...)
+		if err != nil {
+			return err
+		}
+	}
+	if row.Receipt != nil {
+		err = db.SetReceipt(tx, r.ID, row.Receipt)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.AddHistory(tx, r.ID, row.History)
+	if err != nil {
+		return err
+	}
+	err = db.SetEntities(tx, r.ID, entity.Extract(r.Content()))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if im.copies != nil {
+		im.copies[copyHash] = true
+	}
+	im.imported++
+	return nil
+}
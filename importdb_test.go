@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"yangsi/db"
+	"yangsi/img"
+)
+
+func TestImportDuplicateWithoutLocalSHA256(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	other := filepath.Join(dir, "other")
+	err = os.MkdirAll(other, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t"}`, filepath.Join(dir, "t.db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = img.Init([]byte(fmt.Sprintf(`{"out_dir":%q,"out_img":{"max_pixel":1000,"quality":80}}`, filepath.Join(dir, "out"))), filepath.Join(dir, "in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stored before the hash of the original was
+	local := archivePNG(t, dir)
+	data, err := ioutil.ReadFile(local.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(local.Path)
+	err = ioutil.WriteFile(filepath.Join(other, name), data, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the other database has the hash of the same original
+	err = db.Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t"}`, filepath.Join(dir, "other.db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.DB().Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Insert(tx, &db.Record{Time: local.Time, Path: "C:\\yangsi\\out\\" + name, Text: "old",
+		SHA256: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"})
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t"}`, filepath.Join(dir, "t.db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := db.OpenSource(filepath.Join(dir, "other.db"), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	im := &importer{outDir: other}
+	err = src.Each(context.Background(), im.merge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.duplicates != 1 || im.imported != 0 || im.failed != 0 {
+		t.Errorf("%d duplicates, %d imported, %d failed, want the row skipped as a duplicate",
+			im.duplicates, im.imported, im.failed)
+	}
+}
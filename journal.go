@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"yangsi/db"
+	"yangsi/dispose"
+	"yangsi/img"
+	"yangsi/log"
+)
+
+// errArchiveLost is a pending row whose archived copy is under neither name.
+var errArchiveLost = errors.New("archived copy lost")
+
+func tempPath(path string) string {
+	return path + img.TempSuffix
+}
+
+// finish takes a committed row out of pending: its archived copy gets its
+// name, the original is disposed of and the row is marked done. Every step
+// checks whether it was done already, so that it can be run again for a row
+// a crash cut short.
+func finish(r *db.Record) error {
+	_, err := os.Stat(tempPath(r.Path))
+	switch {
+	case err == nil:
+		err = os.Rename(tempPath(r.Path), r.Path)
+		if err != nil {
+			return log.NewError("rename archived copy failed: %s, %s", r.Path, err.Error())
+		}
+	case os.IsNotExist(err):
+		_, err = os.Stat(r.Path)
+		if err != nil {
+			return errArchiveLost
+		}
+	default:
+		return err
+	}
+	// still there, and not another file put there since
+	if sha, err := fileSHA256(r.OrigPath); err == nil && sha == r.SHA256 {
+		err = dispose.Original(r.Disposition, r.OrigPath, r.DisposedPath)
+		if err != nil {
+			return log.NewError("dispose of original failed: %s, %s", r.OrigPath, err.Error())
+		}
+	}
+	// a kept original stays, its job telling the next runs it is stored
+	if r.Disposition != dispose.Keep {
+		err = db.DropJob(r.OrigPath)
+		if err != nil {
+			return err
+		}
+	}
+	return db.SetState(r.ID, db.Done)
+}
+
+// started is when this process started. Temporary copies written since, or
+// shortly before, may be another process's whose row isn't committed yet.
+var started = time.Now()
+
+const tempGrace = time.Minute
+
+// ours tells whether a row left pending by owner is this process's to
+// finish: one of this host whose process is gone, or one left before owners
+// were recorded. Those of live processes and other hosts are theirs.
+func ours(owner string) bool {
+	if owner == "" {
+		return true
+	}
+	host, _ := os.Hostname()
+	k := strings.LastIndexByte(owner, ':')
+	if k < 0 || owner[:k] != host {
+		return false
+	}
+	pid, err := strconv.Atoi(owner[k+1:])
+	return err == nil && (pid == os.Getpid() || !alive(pid))
+}
+
+// alive tells whether the process pid is running. On Windows finding it
+// opens it, which fails once it is gone.
+func alive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		p.Release()
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// recoverPending finishes the rows a crash of this process, or of another
+// one on this host that is gone, left pending and removes the temporary
+// archived copies of rows that were never committed. It runs before any
+// image is handled, so none of ours is being written meanwhile; those of
+// other processes are told by their rows and by their time.
+func recoverPending() error {
+	records, err := db.PendingRecords()
+	if err != nil {
+		return err
+	}
+	var waiting = make(map[string]bool)
+	for k := range records {
+		r := &records[k].Record
+		if !ours(records[k].Owner) {
+			if abs, e := filepath.Abs(tempPath(r.Path)); e == nil {
+				waiting[abs] = true
+			}
+			continue
+		}
+		err = finish(r)
+		switch {
+		case err == errArchiveLost:
+			err = lost(r)
+		case err != nil:
+			if abs, e := filepath.Abs(tempPath(r.Path)); e == nil {
+				waiting[abs] = true
+			}
+		}
+		if err != nil {
+			log.WriteError(err, "recover %d failed", r.ID)
+			continue
+		}
+		log.InfoLog("recovered %d: %s", r.ID, r.OrigPath)
+	}
+	return filepath.Walk(img.OutDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, img.TempSuffix) ||
+			info.ModTime().After(started.Add(-tempGrace)) {
+			return nil
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil || waiting[abs] {
+			return err
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		log.WarnLog("removed uncommitted archived copy: %s", path)
+		return nil
+	})
+}
+
+// lost handles a pending row without its archived copy. It is dropped while
+// the original is still there, to be stored again; the text is all that's
+// left otherwise, kept as done, which db check reports as missing.
+func lost(r *db.Record) error {
+	if sha, err := fileSHA256(r.OrigPath); err == nil && sha == r.SHA256 {
+		err = inTx(func(tx *sql.Tx) error {
+			return db.Delete(tx, r.ID)
+		})
+		if err == nil {
+			log.WarnLog("archived copy of %d lost, dropped to store %s again", r.ID, r.OrigPath)
+		}
+		return err
+	}
+	log.WarnLog("archived copy of %d lost and its original gone: %s", r.ID, r.Path)
+	return db.SetState(r.ID, db.Done)
+}
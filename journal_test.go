@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestOurs(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a process that is gone for sure
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone := cmd.Process.Pid
+
+	var tests = []struct {
+		owner string
+		want  bool
+	}{
+		{"", true},
+		{fmt.Sprintf("%s:%d", host, os.Getpid()), true},
+		{fmt.Sprintf("%s:%d", host, gone), true},
+		{fmt.Sprintf("%s:%d", host, os.Getppid()), false},
+		{fmt.Sprintf("%s-other:%d", host, gone), false},
+		{host, false},
+		{host + ":x", false},
+	}
+	for _, tt := range tests {
+		if got := ours(tt.owner); got != tt.want {
+			t.Errorf("ours(%q) = %v, want %v", tt.owner, got, tt.want)
+		}
+	}
+}
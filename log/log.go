@@ -28,7 +28,8 @@ func init() {
 		ErrorLog("open log file failed: %s, %s", filename, err.Error())
 		os.Exit(1)
 	}
-	stdWriter = os.Stdout
+	// stdout is left to the output of commands
+	stdWriter = os.Stderr
 	InfoLog("============================ start =========================")
 }
 
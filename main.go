@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"image"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -11,15 +13,56 @@ import (
 	"yangsi/baiduocr"
 	"yangsi/cfg"
 	"yangsi/db"
+	"yangsi/dispose"
+	"yangsi/entity"
 	"yangsi/img"
 	"yangsi/log"
+	"yangsi/receipt"
+	"yangsi/redact"
+	"yangsi/retry"
+	"yangsi/rule"
 )
 
 func main() {
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		usage()
+		os.Exit(2)
+	}
+	setup(cmd.need)
+	err := cmd.run(args)
+	if err != nil {
+		log.WriteError(err, "%s failed", cmd.name)
+		os.Exit(1)
+	}
+}
+
+// run finishes what an interrupted run left pending, then walks root once
+// and processes every image found that isn't stored yet, going on from where
+// the last run stopped with each, and trying again the ones that failed as
+// the retry policy says.
+func run(args []string) error {
+	err := recoverPending()
+	if err != nil {
+		return err
+	}
+	counts, err := db.JobCounts()
+	if err != nil {
+		return err
+	}
+	if n := counts[db.JobPending] + counts[db.JobOCRDone] + counts[db.JobFailed]; n > 0 {
+		log.InfoLog("unfinished from earlier runs: %d pending, %d recognized, %d failed",
+			counts[db.JobPending], counts[db.JobOCRDone], counts[db.JobFailed])
+	}
 	process(root)
 	deinit()
 	log.InfoLog("处理成功：%d 张, 处理失败：%d 张", okNum, failedNum)
 	time.Sleep(time.Hour * 24)
+	return nil
 }
 
 var (
@@ -36,27 +79,89 @@ func addFailed() {
 
 var root string
 
-func init() {
+const (
+	needOCR = 1 << iota
+	needDB
+	needIMG
+	// open the database as it is, without migrating it
+	needDBOpen
+	needRules
+	needReceipt
+	needRedact
+	needDispose
+	needRetry
+)
+
+// setup loads the config and initializes the packages a command needs.
+func setup(need int) {
 	conf, err := cfg.Init()
 	if err != nil {
 		log.ErrorLog("cfg init failed: %s", err.Error())
 		os.Exit(1)
 	}
 	root = conf.Root
-	err = baiduocr.Init(conf.OCR)
-	if err != nil {
-		log.ErrorLog("orc init failed: %s", err.Error())
-		os.Exit(1)
+	if need&needOCR != 0 {
+		err = baiduocr.Init(conf.OCR)
+		if err != nil {
+			log.ErrorLog("orc init failed: %s", err.Error())
+			os.Exit(1)
+		}
 	}
-	err = db.Init(conf.DB)
-	if err != nil {
-		log.ErrorLog("db init failed: %s", err.Error())
-		os.Exit(1)
+	if need&needDB != 0 {
+		err = db.Init(conf.DB)
+		if err != nil {
+			log.ErrorLog("db init failed: %s", err.Error())
+			os.Exit(1)
+		}
 	}
-	err = img.Init(conf.IMG)
-	if err != nil {
-		log.ErrorLog("img init failed: %s", err.Error())
-		os.Exit(1)
+	if need&needDBOpen != 0 {
+		err = db.Open(conf.DB)
+		if err != nil {
+			log.ErrorLog("db open failed: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if need&needIMG != 0 {
+		err = img.Init(conf.IMG, conf.Root)
+		if err != nil {
+			log.ErrorLog("img init failed: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if need&needRules != 0 {
+		err = rule.Init(conf.Rules, conf.Root)
+		if err != nil {
+			log.ErrorLog("rule init failed: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if need&needReceipt != 0 {
+		err = receipt.Init(conf.Receipt)
+		if err != nil {
+			log.ErrorLog("receipt init failed: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if need&needRedact != 0 {
+		err = redact.Init(conf.Redact)
+		if err != nil {
+			log.ErrorLog("redact init failed: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if need&needDispose != 0 {
+		err = dispose.Init(conf.Disposition, conf.Root)
+		if err != nil {
+			log.ErrorLog("disposition init failed: %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	if need&needRetry != 0 {
+		err = retry.Init(conf.Retry)
+		if err != nil {
+			log.ErrorLog("retry init failed: %s", err.Error())
+			os.Exit(1)
+		}
 	}
 }
 
@@ -90,14 +195,18 @@ func process(root string) {
 		close(fileCh)
 		wait.Done()
 	}()
+	pool(fileCh, handleImage)
+}
+
+// pool hands the images from fileCh to handle, five at a time, until it is
+// closed.
+func pool(fileCh chan *img.Image, handle func(*img.Image)) {
 	var queue = make(chan struct{}, 5)
 	for file := range fileCh {
-		time.Sleep(time.Millisecond * 100) // 5 次 / s
-
 		wait.Add(1)
 		queue <- struct{}{}
 		go func(img *img.Image) {
-			handleImage(img)
+			handle(img)
 			<-queue
 			wait.Done()
 		}(file)
@@ -146,55 +255,327 @@ func walk(dir string, o *walkOption, file chan *img.Image) error {
 ///////////////////////////////
 func handleImage(img *img.Image) {
 	var err error
+	// why it isn't handled, when it isn't
+	var skipped string
+	// what failed, when something does
+	var stage = db.StageDB
+	var job *db.Job
+	// the row is in, what fails after is left to recoverPending
+	var committed bool
 	defer func() {
-		if err != nil {
+		switch {
+		case err != nil:
 			log.WriteError(err, "%s failed", img.Path())
 			addFailed()
-		} else {
+			if job != nil && !committed {
+				fail(img.Path(), stage, err)
+			}
+		case skipped != "":
+			log.RealtimeLog("%s %s, skipped", img.Path(), skipped)
+		default:
 			log.RealtimeLog("%s ok", img.Path())
 			addOK()
 		}
 	}()
+	job, err = db.Discover(img.Path(), img.Size, img.ModTime)
+	if err != nil {
+		return
+	}
+	if due, at := retry.Due(job, time.Now()); !due {
+		switch {
+		case job.Status == db.JobStored:
+			skipped = "stored before"
+		case job.Class == db.Permanent:
+			skipped = fmt.Sprintf("failed at %s for good", job.Stage)
+		case at.IsZero():
+			skipped = fmt.Sprintf("failed %d times", job.Attempts)
+		default:
+			skipped = fmt.Sprintf("failed before, tried again after %s", at.Format("2006-01-02 15:04:05"))
+		}
+		return
+	}
+	stage = db.StageLoad
+	if dispose.Mode() == dispose.Keep {
+		err = img.Hash()
+		if err != nil {
+			return
+		}
+		var kept bool
+		kept, err = db.Kept(img.Path(), img.SHA256)
+		if err != nil || kept {
+			stage = db.StageDB
+			if kept {
+				skipped = "kept before"
+			}
+			return
+		}
+	}
 	err = img.Load()
 	if err != nil {
 		return
 	}
+	codes := img.Barcodes()
+	stage = db.StageResize
 	imgData, err := img.Smaller()
 	if err != nil {
 		return
 	}
-	orcData, err := baiduocr.OCR(imgData)
+	stage = db.StageOCR
+	ocr, err := ocrImage(img, imgData, job)
 	if err != nil {
 		if _, ok := err.(baiduocr.ErrShouldExit); ok {
 			stop()
 		}
 		return
 	}
+	stage = db.StageRedact
+	err = img.Redact(ocr.Boxes)
+	if err != nil {
+		return
+	}
+	ocrResult := ocr.Result
 	// log.WarnLog("ocr data: %s", orcData)
-	dbh := db.Get()
+	record := &db.Record{
+		Time:        img.ModTime,
+		Text:        ocrResult.Text,
+		OrigPath:    img.Path(),
+		OrigName:    img.Filename(),
+		Size:        img.Size,
+		Width:       img.Width,
+		Height:      img.Height,
+		Format:      img.Format,
+		SHA256:      img.SHA256,
+		OCREngine:   baiduocr.Engine,
+		OCREndpoint: ocrResult.Endpoint,
+		OCRMillis:   ocrResult.Duration.Milliseconds(),
+		ProcessedAt: time.Now(),
+		Direction:   ocrResult.Direction,
+		Confidence:  ocrResult.Confidence,
+		Camera:      img.Camera,
+		Disposition: dispose.Mode(),
+	}
+	stage = db.StageStore
+	record.DisposedPath, err = dispose.Destination(img.Path())
+	if err != nil {
+		return
+	}
+	tags := rule.Tags(record)
+	// before the transaction, it may ask the API again
+	rc := receipt.Read(record.Content(), tags, imgData)
+	// the archived copy is written to a temporary name and the row committed
+	// pending, then finish gives the copy its name and disposes of the
+	// original; recoverPending does that again for a row a crash left pending
+	stage = db.StageDB
+	dbh := db.DB()
 	tx, err := dbh.Begin()
 	if err != nil {
 		return
 	}
 	defer func() {
-		if err != nil {
+		if err != nil && !committed {
 			tx.Rollback()
+			if record.Path != "" {
+				os.Remove(tempPath(record.Path))
+			}
 		}
 	}()
-	path, err := img.Store()
+	stage = db.StageStore
+	record.Path, err = img.Store()
 	if err != nil {
 		return
 	}
-	err = db.Insert(tx, img.ModTime, path, orcData)
+	stage = db.StageDB
+	record.State = db.Pending
+	id, err := db.Insert(tx, record)
 	if err != nil {
 		return
 	}
-	err = os.Remove(img.Path())
+	err = db.Claim(tx, id)
+	if err != nil {
+		return
+	}
+	err = db.Stored(tx, img.Path(), id)
+	if err != nil {
+		return
+	}
+	for _, code := range codes {
+		err = db.InsertCode(tx, id, code.Format, code.Payload)
+		if err != nil {
+			return
+		}
+	}
+	if len(tags) > 0 {
+		err = db.SetAutoTags(tx, id, tags...)
+		if err != nil {
+			return
+		}
+	}
+	err = db.SetEntities(tx, id, entity.Extract(record.Content()))
 	if err != nil {
 		return
 	}
+	if rc != nil {
+		err = db.SetReceipt(tx, id, rc)
+		if err != nil {
+			return
+		}
+	}
 	err = tx.Commit()
 	if err != nil {
 		return
 	}
+	committed = true
+	err = finish(record)
+}
+
+// the OCR calls of ocrFrames, which tests stand in for
+var ocrFrame, locateFrame = baiduocr.OCR, baiduocr.Locate
+
+// ocrFrames recognizes every frame and merges their lines, dropping the ones
+// already seen. A frame without text is fine as long as another has some. The
+// direction is the one of the first frame with text, the confidence the mean
+// of the frames with text and the duration the sum. With locate the lines of
+// the first frame are located, the one archived.
+func ocrFrames(frames [][]byte, locate bool) (*baiduocr.Result, error) {
+	var lines []string
+	var seen = make(map[string]bool)
+	var lastErr error
+	var merged = baiduocr.Result{Direction: -1}
+	var recognized int
+	for k, frame := range frames {
+		recognize := ocrFrame
+		if k == 0 && locate {
+			recognize = locateFrame
+		}
+		result, err := recognize(frame)
+		if err != nil {
+			if _, ok := err.(baiduocr.ErrShouldExit); ok {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		merged.Duration += result.Duration
+		if strings.TrimSpace(result.Text) == "" {
+			continue
+		}
+		if recognized == 0 {
+			merged.Direction = result.Direction
+			merged.Endpoint = result.Endpoint
+		}
+		if k == 0 {
+			merged.Lines = result.Lines
+		}
+		merged.Confidence += result.Confidence
+		recognized++
+		for _, line := range strings.Split(result.Text, "\n") {
+			if line != "" && !seen[line] {
+				seen[line] = true
+				lines = append(lines, line)
+			}
+		}
+	}
+	if len(lines) == 0 {
+		if lastErr == nil {
+			lastErr = log.NewWarn("nothing recognized")
+		}
+		return nil, lastErr
+	}
+	merged.Text = strings.Join(lines, "\n")
+	merged.Confidence /= float64(recognized)
+	return &merged, nil
+}
+
+// recognized is what the job of an image keeps of its OCR, so that a run
+// going on with it doesn't ask for it again: the result with the text already
+// masked and without the lines, and what to black out of the archived copy.
+type recognized struct {
+	Result *baiduocr.Result   `json:"result"`
+	Boxes  []image.Rectangle `json:"boxes,omitempty"`
+}
+
+// ocrImage returns the OCR of the image the job kept, or else asks for it
+// and keeps it in the job.
+func ocrImage(i *img.Image, frames [][]byte, job *db.Job) (*recognized, error) {
+	var ocr recognized
+	if job.OCR != "" {
+		err := json.Unmarshal([]byte(job.OCR), &ocr)
+		if err == nil && ocr.Result != nil {
+			return &ocr, nil
+		}
+		log.WarnLog("invalid ocr kept for %s, recognized again", i.Path())
+	}
+	result, err := ocrFrames(frames, redact.Image())
+	if err != nil {
+		return nil, err
+	}
+	// before anything is stored, the job too
+	ocr.Boxes, err = redactResult(i, result)
+	if err != nil {
+		return nil, err
+	}
+	ocr.Result = result
+	data, err := json.Marshal(&ocr)
+	if err != nil {
+		return nil, log.NewError("marshal ocr failed: %s", err.Error())
+	}
+	return &ocr, db.OCRDone(i.Path(), string(data))
+}
+
+// redactResult masks what is to be redacted in the text and returns where it
+// is to be blacked out of the archived copy when images are redacted too. An
+// image with something to redact that OCR couldn't locate in the first frame
+// is not stored. The lines are dropped, they hold the text unmasked.
+func redactResult(i *img.Image, result *baiduocr.Result) ([]image.Rectangle, error) {
+	lines := result.Lines
+	result.Lines = nil
+	if !redact.On() {
+		return nil, nil
+	}
+	var boxes []image.Rectangle
+	if redact.Image() {
+		if lines == nil && redact.Found(result.Text) {
+			return nil, log.NewWarn("nothing located to redact: %s", i.Path())
+		}
+		boxes = redact.Boxes(lines)
+	}
+	result.Text = redact.Text(result.Text)
+	return boxes, nil
+}
+
+// fail records the failure of the image at path at stage. The image is
+// quarantined first when the failure is its own, up to the redaction, and not
+// one the next run may do better at.
+func fail(path, stage string, cause error) {
+	f := &db.Failure{
+		Path:  path,
+		Stage: stage,
+		Class: retry.Classify(stage, cause),
+		Error: cause.Error(),
+		Time:  time.Now(),
+	}
+	switch stage {
+	case db.StageLoad, db.StageResize, db.StageOCR, db.StageRedact:
+		if f.Class != db.Transient {
+			f.Quarantined = quarantine(path, cause)
+		}
+	}
+	err := db.Failed(f)
+	if err != nil {
+		log.WriteError(err, "record failure of %s failed", path)
+	}
+}
+
+// quarantine moves a failed original away and tells where to, "" if it
+// stays.
+func quarantine(path string, cause error) string {
+	dest, err := dispose.Quarantine(path, cause)
+	if err != nil {
+		log.WriteError(err, "quarantine %s failed", path)
+		return ""
+	}
+	if dest != "" {
+		log.WarnLog("%s quarantined to %s", path, dest)
+	}
+	return dest
 }
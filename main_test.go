@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"yangsi/baiduocr"
+)
+
+func TestOCRFrames(t *testing.T) {
+	// the frames are the results to give back, by their first byte
+	var results = map[byte]*baiduocr.Result{
+		'e': {Text: "", Direction: 2, Confidence: 0.1, Duration: time.Millisecond},
+		'a': {Text: "甲\n乙", Direction: 0, Confidence: 0.9, Duration: time.Millisecond, Endpoint: "a"},
+		'b': {Text: "乙\n丙", Direction: 1, Confidence: 0.5, Duration: time.Millisecond, Endpoint: "b"},
+	}
+	ocrFrame = func(data []byte) (*baiduocr.Result, error) {
+		if data[0] == 'x' {
+			return nil, errors.New("nothing recognized")
+		}
+		r := *results[data[0]]
+		return &r, nil
+	}
+	defer func() { ocrFrame = baiduocr.OCR }()
+
+	var tests = []struct {
+		name       string
+		frames     string
+		text       string
+		direction  int
+		confidence float64
+		duration   time.Duration
+	}{
+		{"one", "a", "甲\n乙", 0, 0.9, time.Millisecond},
+		{"lines merged", "ab", "甲\n乙\n丙", 0, 0.7, 2 * time.Millisecond},
+		{"empty first", "eb", "乙\n丙", 1, 0.5, 2 * time.Millisecond},
+		{"failed first", "xa", "甲\n乙", 0, 0.9, time.Millisecond},
+		{"empty between", "aeb", "甲\n乙\n丙", 0, 0.7, 3 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		var frames [][]byte
+		for k := range tt.frames {
+			frames = append(frames, []byte{tt.frames[k]})
+		}
+		got, err := ocrFrames(frames, false)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got.Text != tt.text || got.Direction != tt.direction || got.Duration != tt.duration ||
+			got.Confidence < tt.confidence-1e-9 || got.Confidence > tt.confidence+1e-9 {
+			t.Errorf("%s: %q, direction %d, confidence %v, duration %v, want %q, %d, %v, %v", tt.name,
+				got.Text, got.Direction, got.Confidence, got.Duration, tt.text, tt.direction, tt.confidence, tt.duration)
+		}
+	}
+
+	for _, frames := range []string{"e", "ee", "x", "xe"} {
+		var data [][]byte
+		for k := range frames {
+			data = append(data, []byte{frames[k]})
+		}
+		if got, err := ocrFrames(data, false); got != nil || err == nil {
+			t.Errorf("%s: %v, %v, want nothing recognized", frames, got, err)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package receipt
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"unicode"
+	"yangsi/baiduocr"
+	"yangsi/db"
+	"yangsi/entity"
+	"yangsi/log"
+)
+
+// config tells which records are invoices or shop receipts: those with one of
+// the tags, or, with detect, those whose text looks like one. With api they
+// are read by Baidu's vat_invoice and shopping_receipt APIs, falling back to
+// the text when those fail.
+type config struct {
+	InvoiceTags []string `json:"invoice_tags"`
+	ReceiptTags []string `json:"receipt_tags"`
+	Detect      bool     `json:"detect"`
+	API         bool     `json:"api"`
+}
+
+var localConf = config{
+	InvoiceTags: []string{"invoice", "发票"},
+	ReceiptTags: []string{"receipt", "小票"},
+	Detect:      true,
+}
+
+// Init reads the config, the defaults being kept for what it leaves out.
+func Init(cfg json.RawMessage) error {
+	if len(cfg) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(cfg, &localConf)
+	if err != nil {
+		return log.NewError("init receipt config failed: %s", err.Error())
+	}
+	return nil
+}
+
+const source = "text"
+
+var (
+	invoiceNumberRe = regexp.MustCompile(`发票号码[:：\s]*(\d{8,20})`)
+	invoiceCodeRe   = regexp.MustCompile(`发票代码[:：\s]*(\d{10,12})`)
+	receiptNumberRe = regexp.MustCompile(`(?:小票号|单据号|流水号|订单号|单号)[:：\s]*([A-Za-z0-9\-]{4,40})`)
+	invoiceDateRe   = regexp.MustCompile(`开票日期[:：\s]*(.+)`)
+	taxRe           = regexp.MustCompile(`税\s*额[:：\s]*[¥￥]?\s*([\d,]+\.\d{1,2})`)
+	merchantRe      = regexp.MustCompile(`(?:商户名称|商家名称|门店名称|店名)\s*[:：]\s*(.+)`)
+	nameRe          = regexp.MustCompile(`名\s*称[:：\s]*(.+)`)
+	usdRe           = regexp.MustCompile(`(?i)\$|USD|美元`)
+	yuanRe          = regexp.MustCompile(`[¥￥]\s*([\d,]+\.\d{1,2})`)
+)
+
+// the lines naming the total, the amount actually paid first
+var (
+	invoiceTotals = []string{"小写", "价税合计"}
+	receiptTotals = []string{"实付", "实收", "应付", "合计", "总计", "总额", "金额", "TOTAL", "Total"}
+	// more than one of these tells a shop receipt
+	receiptWords = []string{"合计", "实付", "实收", "应付", "找零", "收银", "小票", "总计", "单价", "数量", "付款方式"}
+)
+
+func hasTag(tags, names []string) bool {
+	for _, tag := range tags {
+		for _, name := range names {
+			if strings.EqualFold(tag, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Kind is db.Invoice, db.ShopReceipt or "" for a record with text and tags.
+func Kind(text string, tags []string) string {
+	switch {
+	case hasTag(tags, localConf.InvoiceTags):
+		return db.Invoice
+	case hasTag(tags, localConf.ReceiptTags):
+		return db.ShopReceipt
+	case !localConf.Detect:
+		return ""
+	case strings.Contains(text, "发票") &&
+		(strings.Contains(text, "发票号码") || strings.Contains(text, "价税合计") || strings.Contains(text, "开票日期")):
+		return db.Invoice
+	}
+	var n int
+	for _, w := range receiptWords {
+		if strings.Contains(text, w) {
+			n++
+		}
+	}
+	if n >= 2 && entity.FirstDecimal(text) != "" {
+		return db.ShopReceipt
+	}
+	return ""
+}
+
+// Read returns the receipt of a record with text and tags, or nil if it
+// isn't one. The first frame goes to the API when it is on.
+func Read(text string, tags []string, frames [][]byte) *db.Receipt {
+	kind := Kind(text, tags)
+	if kind == "" {
+		return nil
+	}
+	r := Parse(kind, text)
+	if !localConf.API || len(frames) == 0 {
+		return r
+	}
+	var fields *baiduocr.Fields
+	var err error
+	var endpoint string
+	if kind == db.Invoice {
+		endpoint = baiduocr.InvoiceEndpoint
+		fields, err = baiduocr.Invoice(frames[0])
+	} else {
+		endpoint = baiduocr.ReceiptEndpoint
+		fields, err = baiduocr.Receipt(frames[0])
+	}
+	if err != nil {
+		log.WarnLog("read %s by api failed, parsed from the text: %s", kind, err.Error())
+		return r
+	}
+	merge(r, fields)
+	r.Source = endpoint[strings.LastIndex(endpoint, "/")+1:]
+	return r
+}
+
+// merge takes what the API read over what was parsed from the text.
+func merge(r *db.Receipt, f *baiduocr.Fields) {
+	set := func(dst *string, v string) {
+		if v != "" {
+			*dst = v
+		}
+	}
+	set(&r.Merchant, strings.TrimSpace(f.Merchant))
+	set(&r.Date, entity.FirstDate(f.Date))
+	set(&r.Total, entity.FirstDecimal(f.Total))
+	set(&r.Tax, entity.FirstDecimal(f.Tax))
+	set(&r.InvoiceCode, f.InvoiceCode)
+	set(&r.InvoiceNumber, f.InvoiceNumber)
+}
+
+func submatch(re *regexp.Regexp, text string) string {
+	if m := re.FindStringSubmatch(text); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
+
+// afterWord is the first amount after word in lines, on the same line or
+// else on the next.
+func afterWord(lines []string, word string) string {
+	for k, line := range lines {
+		i := strings.Index(line, word)
+		if i < 0 {
+			continue
+		}
+		if v := entity.FirstDecimal(line[i+len(word):]); v != "" {
+			return v
+		}
+		if k+1 < len(lines) {
+			if v := entity.FirstDecimal(lines[k+1]); v != "" {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
+func hans(s string) int {
+	var n int
+	for _, r := range s {
+		if unicode.Is(unicode.Han, r) {
+			n++
+		}
+	}
+	return n
+}
+
+// Parse reads the fields of an invoice or a shop receipt from its text.
+func Parse(kind, text string) *db.Receipt {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	r := &db.Receipt{Kind: kind, Currency: "CNY", Source: source}
+	if usdRe.MatchString(text) && !strings.ContainsAny(text, "¥￥元") {
+		r.Currency = "USD"
+	}
+
+	r.Date = entity.FirstDate(submatch(invoiceDateRe, text))
+	if r.Date == "" {
+		r.Date = entity.FirstDate(text)
+	}
+	r.Tax = entity.FirstDecimal(submatch(taxRe, text))
+	totals := receiptTotals
+	if kind == db.Invoice {
+		totals = invoiceTotals
+		r.InvoiceCode = submatch(invoiceCodeRe, text)
+		r.InvoiceNumber = submatch(invoiceNumberRe, text)
+		r.Merchant = seller(lines)
+		if r.Tax == "" {
+			r.Tax = invoiceTax(lines)
+		}
+	} else {
+		r.InvoiceNumber = submatch(receiptNumberRe, text)
+		r.Merchant = shop(lines, text)
+	}
+	for _, word := range totals {
+		if r.Total = afterWord(lines, word); r.Total != "" {
+			break
+		}
+	}
+	return r
+}
+
+// seller is the 名称 of the 销售方, which comes after the one of the buyer.
+func seller(lines []string) string {
+	var last string
+	for k, line := range lines {
+		if strings.Contains(line, "销售方") {
+			for _, l := range lines[k:] {
+				if name := submatch(nameRe, l); name != "" {
+					return name
+				}
+			}
+		}
+		if name := submatch(nameRe, line); name != "" {
+			last = name
+		}
+	}
+	return last
+}
+
+// invoiceTax is the second amount of the 合计 line, after the amount without
+// tax.
+func invoiceTax(lines []string) string {
+	for _, line := range lines {
+		i := strings.Index(line, "合计")
+		if i < 0 || strings.Contains(line, "价税合计") {
+			continue
+		}
+		amounts := yuanRe.FindAllStringSubmatch(line[i:], -1)
+		if len(amounts) >= 2 {
+			return entity.FirstDecimal(amounts[1][1])
+		}
+	}
+	return ""
+}
+
+// shop is the name the receipt gives, or its first line of Chinese without
+// digits, which is the shop on most of them.
+func shop(lines []string, text string) string {
+	if name := submatch(merchantRe, text); name != "" {
+		return name
+	}
+	for k, line := range lines {
+		if k == 5 {
+			break
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "欢迎光临"))
+		if hans(line) >= 2 && !strings.ContainsAny(line, "0123456789") {
+			return line
+		}
+	}
+	return ""
+}
@@ -0,0 +1,80 @@
+package receipt
+
+import (
+	"testing"
+	"yangsi/db"
+)
+
+const (
+	invoiceText = `电子普通发票
+发票代码：011001900111
+发票号码：12345678
+开票日期：2023年05月06日
+购买方 名称：上海某某贸易有限公司
+销售方 名称：北京某某科技有限公司
+合计 ¥100.00 ¥6.00
+价税合计（大写）壹佰零陆圆整 （小写）¥106.00`
+
+	receiptText = `欢迎光临 好又多超市
+小票号：A2023001
+2023-07-08 12:30
+商品 数量 单价
+牛奶 2 5.50
+合计 11.00
+实付 20.00
+找零 9.00`
+)
+
+func TestKind(t *testing.T) {
+	var tests = []struct {
+		text string
+		tags []string
+		want string
+	}{
+		{"", []string{"Invoice"}, db.Invoice},
+		{"", []string{"other", "小票"}, db.ShopReceipt},
+		{invoiceText, nil, db.Invoice},
+		{receiptText, nil, db.ShopReceipt},
+		// a receipt tag wins over text that looks like an invoice
+		{invoiceText, []string{"receipt"}, db.ShopReceipt},
+		{"这张发票已经作废", nil, ""},
+		{"合计 找零", nil, ""},
+		{"合计 12.00", nil, ""},
+		{"", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := Kind(tt.text, tt.tags); got != tt.want {
+			t.Errorf("Kind(%q, %v) = %q, want %q", tt.text, tt.tags, got, tt.want)
+		}
+	}
+
+	localConf.Detect = false
+	defer func() { localConf.Detect = true }()
+	if got := Kind(receiptText, nil); got != "" {
+		t.Errorf("Kind without detect = %q, want none", got)
+	}
+	if got := Kind(receiptText, []string{"发票"}); got != db.Invoice {
+		t.Errorf("Kind of a tagged invoice without detect = %q, want %q", got, db.Invoice)
+	}
+}
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		kind, text string
+		want       db.Receipt
+	}{
+		{db.Invoice, invoiceText, db.Receipt{Kind: db.Invoice, Merchant: "北京某某科技有限公司", Date: "2023-05-06",
+			Total: "106.00", Tax: "6.00", Currency: "CNY", InvoiceCode: "011001900111", InvoiceNumber: "12345678", Source: source}},
+		{db.ShopReceipt, receiptText, db.Receipt{Kind: db.ShopReceipt, Merchant: "好又多超市", Date: "2023-07-08",
+			Total: "20.00", Currency: "CNY", InvoiceNumber: "A2023001", Source: source}},
+		{db.ShopReceipt, "商家名称：星巴克\n税额：¥1.20\n合计\n¥21.00", db.Receipt{Kind: db.ShopReceipt, Merchant: "星巴克",
+			Total: "21.00", Tax: "1.20", Currency: "CNY", Source: source}},
+		{db.ShopReceipt, "WALMART\n12/01/2023\nTOTAL $12.50", db.Receipt{Kind: db.ShopReceipt,
+			Total: "12.50", Currency: "USD", Source: source}},
+	}
+	for _, tt := range tests {
+		if got := Parse(tt.kind, tt.text); *got != tt.want {
+			t.Errorf("Parse(%s, %q) = %+v, want %+v", tt.kind, tt.text, *got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"yangsi/db"
+	"yangsi/log"
+	"yangsi/receipt"
+)
+
+var receiptCommands = map[string]func(args []string) error{
+	"parse":  receiptParse,
+	"export": receiptExport,
+}
+
+func receiptCommand(args []string) error {
+	if len(args) == 0 || receiptCommands[args[0]] == nil {
+		return log.NewError("unknown receipt command: %v, want parse or export", args)
+	}
+	return receiptCommands[args[0]](args[1:])
+}
+
+// receiptParse reads the receipts of the given records, or of every one,
+// from their text again, for the records tagged as receipts after they were
+// stored or corrected since. What the API read is replaced too.
+func receiptParse(args []string) error {
+	fs := flag.NewFlagSet("receipt parse", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print what would be read")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	var records []db.Record
+	for _, arg := range fs.Args() {
+		id, err := parseID(arg)
+		if err != nil {
+			return err
+		}
+		r, err := db.Get(id)
+		if err != nil {
+			return err
+		}
+		records = append(records, *r)
+	}
+	if len(records) > 0 {
+		_, err = parseReceipts(records, *dryRun)
+		return err
+	}
+	var total, found int
+	for offset := 0; ; offset += retagBatch {
+		records, err := db.Find(&db.Filter{Limit: retagBatch, Offset: offset})
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		total += len(records)
+		n, err := parseReceipts(records, *dryRun)
+		if err != nil {
+			return err
+		}
+		found += n
+	}
+	log.InfoLog("%d receipts found in %d records", found, total)
+	return nil
+}
+
+// parseReceipts reads the receipts of records and tells how many are.
+func parseReceipts(records []db.Record, dryRun bool) (int, error) {
+	// the tags first, SQLite can't be read and written at once
+	var receipts = make([]*db.Receipt, len(records))
+	var found int
+	for k := range records {
+		tags, err := db.Tags(records[k].ID)
+		if err != nil {
+			return 0, err
+		}
+		receipts[k] = receipt.Read(records[k].Content(), tags, nil)
+		if receipts[k] != nil {
+			found++
+		}
+	}
+	if dryRun {
+		for k, rc := range receipts {
+			if rc != nil {
+				fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\t%s\n", records[k].ID, rc.Kind, rc.Date, rc.Merchant, rc.Total, rc.Tax, rc.InvoiceNumber)
+			}
+		}
+		return found, nil
+	}
+	return found, inTx(func(tx *sql.Tx) error {
+		for k, rc := range receipts {
+			err := db.SetReceipt(tx, records[k].ID, rc)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+var receiptHeader = []string{"id", "date", "kind", "merchant", "total", "tax", "currency",
+	"invoice_code", "invoice_number", "source", "path"}
+
+// receiptExport writes the receipts of the records matching the flags as CSV
+// for expense reports, by date.
+func receiptExport(args []string) error {
+	fs := flag.NewFlagSet("receipt export", flag.ExitOnError)
+	out := fs.String("out", "", "file to write, stdout if empty")
+	from := fs.String("from", "", "only images modified at or after this date/time")
+	to := fs.String("to", "", "only images modified at or before this date/time")
+	path := fs.String("path", "", "only archived paths containing this")
+	tag := fs.String("tag", "", "only records with this tag")
+	terms, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	var filter = db.Filter{
+		Terms: terms,
+		Path:  *path,
+		Tag:   *tag,
+	}
+	filter.From, err = parseTime(*from, false)
+	if err != nil {
+		return err
+	}
+	filter.To, err = parseTime(*to, true)
+	if err != nil {
+		return err
+	}
+	receipts, err := db.Receipts(&filter)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return log.NewError("create export file failed: %s", err.Error())
+		}
+		defer file.Close()
+		w = file
+	}
+	buf := bufio.NewWriter(w)
+	// for Excel to read it as UTF-8
+	_, err = io.WriteString(buf, utf8BOM)
+	if err != nil {
+		return log.NewError("write export failed: %s", err.Error())
+	}
+	cw := csv.NewWriter(buf)
+	err = cw.Write(receiptHeader)
+	for k := 0; err == nil && k < len(receipts); k++ {
+		r := &receipts[k]
+		err = cw.Write([]string{strconv.FormatInt(r.RecordID, 10), r.Date, r.Kind, r.Merchant, r.Total, r.Tax,
+			r.Currency, r.InvoiceCode, r.InvoiceNumber, r.Source, r.Path})
+	}
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err != nil {
+		return log.NewError("write export failed: %s", err.Error())
+	}
+	log.InfoLog("exported %d receipts", len(receipts))
+	return nil
+}
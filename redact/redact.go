@@ -0,0 +1,104 @@
+package redact
+
+import (
+	"encoding/json"
+	"image"
+	"strings"
+	"yangsi/baiduocr"
+	"yangsi/entity"
+	"yangsi/log"
+)
+
+// config names the entity kinds masked in the stored text, see package
+// entity, e.g. ["id", "card"]; none turns redaction off. With image they are
+// blacked out in the archived image too, where OCR located them.
+type config struct {
+	Kinds []string `json:"kinds"`
+	Image bool     `json:"image"`
+}
+
+func (c *config) check() error {
+	for _, kind := range c.Kinds {
+		if !entity.Known(kind) {
+			return log.NewError("unknown entity kind to redact: %s, want one of %s", kind, strings.Join(entity.Kinds, ", "))
+		}
+	}
+	return nil
+}
+
+var localConf config
+
+func Init(cfg json.RawMessage) error {
+	if len(cfg) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(cfg, &localConf)
+	if err != nil {
+		return log.NewError("init redact config failed: %s", err.Error())
+	}
+	return localConf.check()
+}
+
+// On tells whether anything is redacted.
+func On() bool {
+	return len(localConf.Kinds) > 0
+}
+
+// Image tells whether the archived images are redacted too, which needs OCR
+// to locate the text.
+func Image() bool {
+	return On() && localConf.Image
+}
+
+// Text masks the entities in text.
+func Text(text string) string {
+	if !On() {
+		return text
+	}
+	return entity.Mask(text, localConf.Kinds...)
+}
+
+// Found tells whether text has something to redact.
+func Found(text string) bool {
+	return On() && len(entity.Spans(text, localConf.Kinds...)) > 0
+}
+
+// Boxes returns where the entities are in the located lines: the boxes of
+// their characters, or of the whole line when the characters don't spell
+// them out.
+func Boxes(lines []baiduocr.Line) []image.Rectangle {
+	var boxes []image.Rectangle
+	for _, line := range lines {
+		want := entity.Spans(line.Text, localConf.Kinds...)
+		if len(want) == 0 {
+			continue
+		}
+		// the characters leave out the spaces, so spans are found again in
+		// what they spell, knowing where each one starts
+		var spelled strings.Builder
+		var starts []int
+		for _, c := range line.Chars {
+			starts = append(starts, spelled.Len())
+			spelled.WriteString(c.Char)
+		}
+		spans := entity.Spans(spelled.String(), localConf.Kinds...)
+		if len(spans) < len(want) {
+			boxes = append(boxes, line.Box)
+			continue
+		}
+		for _, s := range spans {
+			var box image.Rectangle
+			for k, c := range line.Chars {
+				end := spelled.Len()
+				if k+1 < len(starts) {
+					end = starts[k+1]
+				}
+				if starts[k] < s[1] && end > s[0] {
+					box = box.Union(c.Box)
+				}
+			}
+			boxes = append(boxes, box)
+		}
+	}
+	return boxes
+}
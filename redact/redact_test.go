@@ -0,0 +1,53 @@
+package redact
+
+import (
+	"image"
+	"reflect"
+	"testing"
+	"yangsi/baiduocr"
+)
+
+// line lays out the characters of spelled 10 pixels apart, as OCR locates
+// a line that reads text.
+func line(text, spelled string) baiduocr.Line {
+	l := baiduocr.Line{Text: text}
+	for k, r := range []rune(spelled) {
+		l.Chars = append(l.Chars, baiduocr.Char{Char: string(r), Box: image.Rect(10*k, 0, 10*k+10, 20)})
+	}
+	l.Box = image.Rect(0, 0, 10*len(l.Chars), 20)
+	return l
+}
+
+func TestBoxes(t *testing.T) {
+	localConf.Kinds = []string{"phone", "card"}
+	defer func() { localConf.Kinds = nil }()
+
+	noChars := line("电话 13800138000", "")
+	noChars.Box = image.Rect(0, 0, 300, 20)
+	var tests = []struct {
+		name  string
+		lines []baiduocr.Line
+		want  []image.Rectangle
+	}{
+		{"nothing to redact", []baiduocr.Line{line("合计 12.00", "合计12.00")}, nil},
+		{"characters without the space", []baiduocr.Line{line("电话 13800138000", "电话13800138000")},
+			[]image.Rectangle{image.Rect(20, 0, 130, 20)}},
+		{"two in a line", []baiduocr.Line{line("13800138000 卡 4111 1111 1111 1111", "13800138000卡4111111111111111")},
+			[]image.Rectangle{image.Rect(0, 0, 110, 20), image.Rect(120, 0, 280, 20)}},
+		{"no characters", []baiduocr.Line{noChars}, []image.Rectangle{image.Rect(0, 0, 300, 20)}},
+		{"characters spell it wrong", []baiduocr.Line{line("电话 13800138000", "电话1380013800")},
+			[]image.Rectangle{image.Rect(0, 0, 120, 20)}},
+		{"one box per line", []baiduocr.Line{line("无", "无"), line("13800138000", "13800138000")},
+			[]image.Rectangle{image.Rect(0, 0, 110, 20)}},
+	}
+	for _, tt := range tests {
+		if got := Boxes(tt.lines); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Boxes = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	localConf.Kinds = nil
+	if got := Boxes([]baiduocr.Line{line("13800138000", "13800138000")}); got != nil {
+		t.Errorf("Boxes with nothing to redact = %v, want none", got)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+	"yangsi/baiduocr"
+	"yangsi/db"
+	"yangsi/entity"
+	"yangsi/img"
+	"yangsi/log"
+	"yangsi/redact"
+)
+
+// reocr recognizes the archived copies of the selected rows again and
+// replaces their text, keeping the old one in the history table. Requests go
+// through the same rate limiter as run.
+func reocr(args []string) error {
+	fs := flag.NewFlagSet("reocr", flag.ExitOnError)
+	from := fs.String("from", "", "only images modified at or after this date/time")
+	to := fs.String("to", "", "only images modified at or before this date/time")
+	path := fs.String("path", "", "only archived paths containing this")
+	engine := fs.String("engine", "", "only rows recognized by this OCR engine")
+	empty := fs.Bool("empty", false, "only rows without text")
+	short := fs.Int("short", 0, "only rows whose text has fewer characters than this")
+	confidence := fs.Float64("confidence", 0, "only rows whose confidence is below this, 0 to 1")
+	all := fs.Bool("all", false, "every row, when no other filter is given")
+	limit := fs.Int("limit", 0, "max rows, 0 for all")
+	dryRun := fs.Bool("dry-run", false, "only list the rows that would be recognized again")
+	terms, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	var filter = db.Filter{
+		Terms:         terms,
+		Path:          *path,
+		Engine:        *engine,
+		ShortText:     *short,
+		LowConfidence: *confidence,
+		Limit:         *limit,
+	}
+	if *empty {
+		filter.ShortText = 1
+	}
+	filter.From, err = parseTime(*from, false)
+	if err != nil {
+		return err
+	}
+	filter.To, err = parseTime(*to, true)
+	if err != nil {
+		return err
+	}
+	if !*all && len(terms) == 0 && *from == "" && *to == "" && *path == "" && *engine == "" &&
+		filter.ShortText == 0 && *confidence == 0 {
+		return log.NewError("reocr needs a filter, or -all to recognize every row again")
+	}
+
+	// read them all first, SQLite can't be written while a query is open
+	records, err := db.Find(&filter)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		for _, r := range records {
+			fmt.Printf("%d\t%s\t%s\t%s\t%.2f\n", r.ID, r.Time.Format(timeLayout), r.Path, r.OCREngine, r.Confidence)
+		}
+		return nil
+	}
+	var wait sync.WaitGroup
+	var queue = make(chan struct{}, 5)
+loop:
+	for k := range records {
+		select {
+		case queue <- struct{}{}:
+		case <-closeCh:
+			break loop
+		}
+		wait.Add(1)
+		go func(r *db.Record) {
+			err := reocrRecord(r)
+			if err != nil {
+				log.WriteError(err, "reocr %d failed", r.ID)
+				addFailed()
+				if _, ok := err.(baiduocr.ErrShouldExit); ok {
+					stop()
+				}
+			} else {
+				log.RealtimeLog("reocr %d ok", r.ID)
+				addOK()
+			}
+			<-queue
+			wait.Done()
+		}(&records[k])
+	}
+	wait.Wait()
+	log.InfoLog("处理成功：%d 张, 处理失败：%d 张", okNum, failedNum)
+	return nil
+}
+
+func reocrRecord(r *db.Record) error {
+	image, err := img.NewImage(filepath.Dir(r.Path), filepath.Base(r.Path))
+	if err != nil {
+		return err
+	}
+	err = image.Load()
+	if err != nil {
+		return err
+	}
+	// the crop rules are of the original, not of the downsampled copy
+	image.AsOriginal(r.OrigPath, r.Width, r.Height)
+	imgData, err := image.Smaller()
+	if err != nil {
+		return err
+	}
+	result, err := ocrFrames(imgData, false)
+	if err != nil {
+		return err
+	}
+	// the archived copy was redacted when stored, if it was to be
+	r.Text = redact.Text(result.Text)
+	r.OCREngine = baiduocr.Engine
+	r.OCREndpoint = result.Endpoint
+	r.OCRMillis = result.Duration.Milliseconds()
+	r.ProcessedAt = time.Now()
+	r.Direction = result.Direction
+	r.Confidence = result.Confidence
+
+	tx, err := db.DB().Begin()
+	if err != nil {
+		return err
+	}
+	err = db.Revise(tx, r)
+	if err == nil {
+		err = db.SetEntities(tx, r.ID, entity.Extract(r.Content()))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"yangsi/baiduocr"
+	"yangsi/db"
+	"yangsi/img"
+)
+
+// archivePNG stores a PNG original the way run does and returns its record.
+func archivePNG(t *testing.T, dir string) *db.Record {
+	in := filepath.Join(dir, "in")
+	err := os.MkdirAll(in, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	for k := range src.Pix {
+		src.Pix[k] = uint8(k)
+	}
+	f, err := os.Create(filepath.Join(in, "a.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = png.Encode(f, src)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := img.NewImage(in, "a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = image.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = image.Smaller()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, err := image.Store()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(path+img.TempSuffix, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(path, "_o.png") {
+		t.Fatalf("archived as %s, want a .png name", path)
+	}
+
+	r := &db.Record{Time: image.ModTime, Path: path, Text: "old", Format: image.Format,
+		Width: image.Width, Height: image.Height}
+	tx, err := db.DB().Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Insert(tx, r)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReocrPNGOrigin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "yangsi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = db.Init([]byte(fmt.Sprintf(`{"driver":"sqlite3","db_name":%q,"tb_name":"t"}`, filepath.Join(dir, "t.db"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = img.Init([]byte(fmt.Sprintf(`{"out_dir":%q,"out_img":{"max_pixel":1000,"quality":80}}`, filepath.Join(dir, "out"))), filepath.Join(dir, "in"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := archivePNG(t, dir)
+
+	var calls int
+	ocrFrame = func(data []byte) (*baiduocr.Result, error) {
+		calls++
+		return &baiduocr.Result{Text: "new", Direction: 0, Confidence: 0.9, Duration: time.Millisecond}, nil
+	}
+	defer func() { ocrFrame = baiduocr.OCR }()
+	err = reocrRecord(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("%d OCR calls, want 1", calls)
+	}
+	got, err := db.Get(r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "new" {
+		t.Errorf("text %q, want %q", got.Text, "new")
+	}
+}
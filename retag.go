@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"strings"
+	"yangsi/db"
+	"yangsi/log"
+	"yangsi/rule"
+)
+
+// records read and retagged at a time; SQLite can't be written while a
+// query is open, so they are read first
+const retagBatch = 500
+
+// retag replaces the tags rules put on every record with the ones the rules
+// in conf.json put now. Tags put by hand are kept.
+func retag(args []string) error {
+	fs := flag.NewFlagSet("retag", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only print the tags rules would put on each record")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	var total, tagged int
+	for offset := 0; ; offset += retagBatch {
+		records, err := db.Find(&db.Filter{Limit: retagBatch, Offset: offset})
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		total += len(records)
+		if *dryRun {
+			for k := range records {
+				if tags := rule.Tags(&records[k]); len(tags) > 0 {
+					tagged++
+					fmt.Printf("%d\t%s\t%s\n", records[k].ID, records[k].Path, strings.Join(tags, ","))
+				}
+			}
+			continue
+		}
+		err = inTx(func(tx *sql.Tx) error {
+			for k := range records {
+				tags := rule.Tags(&records[k])
+				if len(tags) > 0 {
+					tagged++
+				}
+				err := db.SetAutoTags(tx, records[k].ID, tags...)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	log.InfoLog("%d of %d records tagged by rules", tagged, total)
+	return nil
+}
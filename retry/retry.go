@@ -0,0 +1,82 @@
+package retry
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+	"yangsi/baiduocr"
+	"yangsi/db"
+	"yangsi/log"
+)
+
+// config says how often a file that failed with a db.OtherError is tried
+// again by the next runs: up to max_attempts attempts in all, waiting
+// backoff_minutes after the first failure and twice as long after each one
+// since. Transient failures are tried again by the next run whatever the
+// attempts, permanent ones only by failures retry.
+type config struct {
+	MaxAttempts    int `json:"max_attempts"`
+	BackoffMinutes int `json:"backoff_minutes"`
+}
+
+func (c *config) check() error {
+	if c.MaxAttempts < 1 {
+		return log.NewError("invalid retry max_attempts: %d, want at least 1", c.MaxAttempts)
+	}
+	if c.BackoffMinutes < 0 {
+		return log.NewError("invalid retry backoff_minutes: %d", c.BackoffMinutes)
+	}
+	return nil
+}
+
+var localConf = config{MaxAttempts: 3, BackoffMinutes: 10}
+
+// Init reads the config, the defaults being kept for what it leaves out.
+func Init(cfg json.RawMessage) error {
+	if len(cfg) > 0 {
+		err := json.Unmarshal(cfg, &localConf)
+		if err != nil {
+			return log.NewError("init retry config failed: %s", err.Error())
+		}
+	}
+	return localConf.check()
+}
+
+// Classify tells the class of a failure at stage. The OCR service and the
+// network fail for a while, a file that can't be read fails for good, unless
+// it is opening it that failed.
+func Classify(stage string, err error) string {
+	var pathErr *os.PathError
+	switch {
+	case baiduocr.Transient(err):
+		return db.Transient
+	case (stage == db.StageLoad || stage == db.StageResize) && !errors.As(err, &pathErr):
+		return db.Permanent
+	}
+	return db.OtherError
+}
+
+// Due tells whether the job is to be handled now, and when it will be if
+// it isn't and ever will; a zero time means never.
+func Due(j *db.Job, now time.Time) (bool, time.Time) {
+	switch j.Status {
+	case db.JobStored:
+		return false, time.Time{}
+	case db.JobFailed:
+	default:
+		return true, now
+	}
+	switch j.Class {
+	case db.Transient:
+		return true, now
+	case db.Permanent:
+		return false, time.Time{}
+	}
+	if j.Attempts >= localConf.MaxAttempts {
+		return false, time.Time{}
+	}
+	wait := time.Duration(localConf.BackoffMinutes) * time.Minute << uint(j.Attempts-1)
+	at := j.UpdatedAt.Add(wait)
+	return !now.Before(at), at
+}
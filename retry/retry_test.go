@@ -0,0 +1,59 @@
+package retry
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+	"yangsi/db"
+)
+
+func TestDue(t *testing.T) {
+	localConf = config{MaxAttempts: 3, BackoffMinutes: 10}
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.Local)
+	failed := func(class string, attempts int, ago time.Duration) *db.Job {
+		return &db.Job{Status: db.JobFailed, Class: class, Attempts: attempts, UpdatedAt: now.Add(-ago)}
+	}
+	var tests = []struct {
+		name string
+		job  *db.Job
+		due  bool
+		at   time.Time
+	}{
+		{"pending", &db.Job{Status: db.JobPending}, true, now},
+		{"ocr done", &db.Job{Status: db.JobOCRDone}, true, now},
+		{"stored", &db.Job{Status: db.JobStored}, false, time.Time{}},
+		{"transient", failed(db.Transient, 9, 0), true, now},
+		{"permanent", failed(db.Permanent, 1, time.Hour), false, time.Time{}},
+		{"first backoff waiting", failed(db.OtherError, 1, 5*time.Minute), false, now.Add(5 * time.Minute)},
+		{"first backoff over", failed(db.OtherError, 1, 10*time.Minute), true, now},
+		{"second backoff doubled", failed(db.OtherError, 2, 15*time.Minute), false, now.Add(5 * time.Minute)},
+		{"second backoff over", failed(db.OtherError, 2, 20*time.Minute), true, now},
+		{"attempts used up", failed(db.OtherError, 3, 24*time.Hour), false, time.Time{}},
+	}
+	for _, tt := range tests {
+		due, at := Due(tt.job, now)
+		if due != tt.due || !at.Equal(tt.at) {
+			t.Errorf("%s: Due %v %s, want %v %s", tt.name, due, at, tt.due, tt.at)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	var tests = []struct {
+		stage string
+		err   error
+		want  string
+	}{
+		{db.StageLoad, errors.New("png: invalid format"), db.Permanent},
+		{db.StageResize, errors.New("crop rule leaves nothing"), db.Permanent},
+		{db.StageLoad, &os.PathError{Op: "open", Path: "a.png", Err: os.ErrPermission}, db.OtherError},
+		{db.StageOCR, errors.New("no text"), db.OtherError},
+		{db.StageDB, errors.New("database is locked"), db.OtherError},
+	}
+	for _, tt := range tests {
+		if got := Classify(tt.stage, tt.err); got != tt.want {
+			t.Errorf("Classify(%s, %v) = %s, want %s", tt.stage, tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package rule
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+	"yangsi/db"
+	"yangsi/log"
+)
+
+// Rule puts Tag on the records matching every condition it has:
+//
+//	text    regexp over the text, corrected if it was
+//	dir     subdirectory of the root dir the original was in, or below, or a
+//	        glob of one, e.g. "wechat" or "*/screenshots"
+//	camera  regexp over the make and model from the EXIF
+//	min_width, max_width, min_height, max_height in pixels of the original
+//
+// e.g. {"tag": "invoice", "text": "发票号码"} or {"tag": "chat", "dir": "wechat"}.
+type Rule struct {
+	Tag       string `json:"tag"`
+	Text      string `json:"text"`
+	Dir       string `json:"dir"`
+	Camera    string `json:"camera"`
+	MinWidth  int    `json:"min_width"`
+	MaxWidth  int    `json:"max_width"`
+	MinHeight int    `json:"min_height"`
+	MaxHeight int    `json:"max_height"`
+
+	text   *regexp.Regexp
+	camera *regexp.Regexp
+}
+
+func (r *Rule) check() error {
+	var err error
+	if strings.TrimSpace(r.Tag) == "" {
+		return log.NewError("rule without tag: %+v", *r)
+	}
+	if r.Text == "" && r.Dir == "" && r.Camera == "" && r.MinWidth == 0 && r.MaxWidth == 0 &&
+		r.MinHeight == 0 && r.MaxHeight == 0 {
+		return log.NewError("rule without condition: %s", r.Tag)
+	}
+	if r.Text != "" {
+		r.text, err = regexp.Compile(r.Text)
+		if err != nil {
+			return log.NewError("invalid text of rule %s: %s", r.Tag, err.Error())
+		}
+	}
+	if r.Camera != "" {
+		r.camera, err = regexp.Compile(r.Camera)
+		if err != nil {
+			return log.NewError("invalid camera of rule %s: %s", r.Tag, err.Error())
+		}
+	}
+	if r.Dir != "" {
+		r.Dir = strings.Trim(path.Clean("/"+strings.Replace(r.Dir, "\\", "/", -1)), "/")
+		_, err = path.Match(r.Dir, "")
+		if err != nil {
+			return log.NewError("invalid dir of rule %s: %s", r.Tag, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *Rule) match(rec *db.Record) bool {
+	if r.text != nil && !r.text.MatchString(rec.Content()) {
+		return false
+	}
+	if r.camera != nil && !r.camera.MatchString(rec.Camera) {
+		return false
+	}
+	if r.Dir != "" && !r.underDir(subdir(rec.OrigPath)) {
+		return false
+	}
+	return (r.MinWidth == 0 || rec.Width >= r.MinWidth) && (r.MaxWidth == 0 || rec.Width <= r.MaxWidth) &&
+		(r.MinHeight == 0 || rec.Height >= r.MinHeight) && (r.MaxHeight == 0 || rec.Height <= r.MaxHeight)
+}
+
+// underDir tells whether dir or one of the dirs it is in matches r.Dir.
+func (r *Rule) underDir(dir string) bool {
+	parts := strings.Split(dir, "/")
+	for k := range parts {
+		if ok, _ := path.Match(r.Dir, strings.Join(parts[:k+1], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	rules []Rule
+	root  string
+)
+
+// subdir is the dir of an original relative to the root dir.
+func subdir(origPath string) string {
+	dir := path.Dir(path.Clean(strings.Replace(origPath, "\\", "/", -1)))
+	dir = strings.TrimPrefix(dir+"/", root+"/")
+	return strings.Trim(dir, "/")
+}
+
+// Init loads the rules; rootDir is the dir originals are found in.
+func Init(cfg json.RawMessage, rootDir string) error {
+	rules = nil
+	root = path.Clean(strings.Replace(rootDir, "\\", "/", -1))
+	if len(cfg) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(cfg, &rules)
+	if err != nil {
+		return log.NewError("unmarshal rules failed: %s, %s", string(cfg), err.Error())
+	}
+	for k := range rules {
+		err = rules[k].check()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tags returns the tags of the rules matching rec, each once.
+func Tags(rec *db.Record) []string {
+	var tags []string
+	var seen = make(map[string]bool)
+	for k := range rules {
+		tag := strings.TrimSpace(rules[k].Tag)
+		if !seen[tag] && rules[k].match(rec) {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
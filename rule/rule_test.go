@@ -0,0 +1,72 @@
+package rule
+
+import (
+	"strings"
+	"testing"
+	"yangsi/db"
+)
+
+func TestTags(t *testing.T) {
+	err := Init([]byte(`[
+		{"tag": "invoice", "text": "发票号码"},
+		{"tag": "chat", "dir": "wechat"},
+		{"tag": "shot", "dir": "*/screenshots"},
+		{"tag": "iphone", "camera": "(?i)^apple iphone"},
+		{"tag": "large", "min_width": 3000},
+		{"tag": "small", "max_width": 200, "max_height": 200},
+		{"tag": "tall", "min_height": 2000, "max_width": 1200},
+		{"tag": "wechat invoice", "text": "发票", "dir": "wechat"},
+		{"tag": "invoice", "text": "增值税"}
+	]`), "/data/in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name string
+		rec  db.Record
+		want []string
+	}{
+		{"text", db.Record{Text: "发票号码：123", OrigPath: "/data/in/a.jpg", Width: 1000, Height: 1000}, []string{"invoice"}},
+		{"corrected text", db.Record{Text: "发栗号码", CorrectedText: "发票号码", OrigPath: "/data/in/a.jpg", Width: 1000, Height: 1000}, []string{"invoice"}},
+		{"dir", db.Record{OrigPath: "/data/in/wechat/a.jpg", Width: 1000, Height: 1000}, []string{"chat"}},
+		{"below dir", db.Record{OrigPath: "/data/in/wechat/2023/05/a.jpg", Width: 1000, Height: 1000}, []string{"chat"}},
+		{"dir prefix only", db.Record{OrigPath: "/data/in/wechat2/a.jpg", Width: 1000, Height: 1000}, nil},
+		{"dir glob", db.Record{OrigPath: "/data/in/phone/screenshots/x/a.png", Width: 1000, Height: 1000}, []string{"shot"}},
+		{"dir glob too shallow", db.Record{OrigPath: "/data/in/screenshots/a.png", Width: 1000, Height: 1000}, nil},
+		{"camera", db.Record{Camera: "Apple iPhone 12", OrigPath: "/data/in/a.jpg", Width: 1000, Height: 1000}, []string{"iphone"}},
+		{"camera not at start", db.Record{Camera: "not Apple iPhone", OrigPath: "/data/in/a.jpg", Width: 1000, Height: 1000}, nil},
+		{"min width", db.Record{OrigPath: "/data/in/a.jpg", Width: 3000, Height: 1000}, []string{"large"}},
+		{"max width and height", db.Record{OrigPath: "/data/in/a.jpg", Width: 200, Height: 100}, []string{"small"}},
+		{"max width but not height", db.Record{OrigPath: "/data/in/a.jpg", Width: 200, Height: 300}, nil},
+		{"min height and max width", db.Record{OrigPath: "/data/in/a.jpg", Width: 1080, Height: 2340}, []string{"tall"}},
+		{"every condition", db.Record{Text: "发票号码", OrigPath: "/data/in/wechat/a.jpg", Width: 1000, Height: 1000},
+			[]string{"invoice", "chat", "wechat invoice"}},
+		{"tag once", db.Record{Text: "增值税 发票号码", OrigPath: "/data/in/a.jpg", Width: 1000, Height: 1000}, []string{"invoice"}},
+		{"none", db.Record{Text: "会议纪要", OrigPath: "/data/in/a.jpg", Width: 1000, Height: 1000}, nil},
+	}
+	for _, tt := range tests {
+		got := Tags(&tt.rec)
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: tags %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInitInvalid(t *testing.T) {
+	var tests = []struct {
+		cfg, want string
+	}{
+		{`[{"tag": "a", "text": "("}]`, "invalid text of rule a"},
+		{`[{"tag": "a", "camera": "[z-a]"}]`, "invalid camera of rule a"},
+		{`[{"tag": "a", "dir": "wechat/["}]`, "invalid dir of rule a"},
+		{`[{"tag": " ", "text": "x"}]`, "rule without tag"},
+		{`[{"tag": "a"}]`, "rule without condition: a"},
+		{`{"tag": "a"}`, "unmarshal rules failed"},
+	}
+	for _, tt := range tests {
+		err := Init([]byte(tt.cfg), "/data/in")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: %v, want %q", tt.cfg, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"yangsi/db"
+	"yangsi/entity"
+	"yangsi/log"
+)
+
+const (
+	timeLayout = "2006-01-02 15:04:05"
+	dateLayout = "2006-01-02"
+)
+
+// parseTime accepts a local date or a date and time. A bare date used as an
+// upper bound covers the whole day.
+func parseTime(s string, upper bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation(timeLayout, s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(dateLayout, s, time.Local)
+	if err != nil {
+		return time.Time{}, log.NewError("invalid time: %s, want %s or %s", s, dateLayout, timeLayout)
+	}
+	if upper {
+		t = t.Add(time.Hour*24 - time.Second)
+	}
+	return t, nil
+}
+
+// entityFlags collects repeated -entity kind[:value] flags.
+type entityFlags []db.EntityFilter
+
+func (e *entityFlags) String() string {
+	var parts []string
+	for _, f := range *e {
+		parts = append(parts, f.Kind+":"+f.Value)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (e *entityFlags) Set(s string) error {
+	f := db.ParseEntityFilter(s)
+	if !entity.Known(f.Kind) {
+		return log.NewError("unknown entity kind: %s, want one of %s", f.Kind, strings.Join(entity.Kinds, ", "))
+	}
+	f.Value = entity.Prefix(f.Kind, f.Value)
+	*e = append(*e, f)
+	return nil
+}
+
+// isTerminal tells whether f is a terminal rather than a file or a pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func search(args []string) error {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	from := fs.String("from", "", "only images modified at or after this date/time")
+	to := fs.String("to", "", "only images modified at or before this date/time")
+	path := fs.String("path", "", "only archived paths containing this")
+	tag := fs.String("tag", "", "only records with this tag")
+	var entities entityFlags
+	fs.Var(&entities, "entity", "only records with an entity of this kind whose value starts with this, kind[:value], repeatable")
+	limit := fs.Int("limit", 20, "max results, 0 for all")
+	offset := fs.Int("offset", 0, "results to skip")
+	asJSON := fs.Bool("json", false, "print one JSON object per line")
+	color := fs.Bool("color", isTerminal(os.Stdout), "highlight matches with terminal colors, by default when stdout is a terminal")
+	terms, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	var filter = db.Filter{
+		Terms:    terms,
+		Path:     *path,
+		Tag:      *tag,
+		Entities: entities,
+		Limit:    *limit,
+		Offset:   *offset,
+		Mark:     [2]string{"\x1b[1;31m", "\x1b[0m"},
+	}
+	if *asJSON || !*color {
+		filter.Mark = [2]string{"[", "]"}
+	}
+	filter.From, err = parseTime(*from, false)
+	if err != nil {
+		return err
+	}
+	filter.To, err = parseTime(*to, true)
+	if err != nil {
+		return err
+	}
+
+	hits, err := db.Query(&filter)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		for k := range hits {
+			err = enc.Encode(&hits[k])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, hit := range hits {
+		fmt.Printf("%d\t%s\t%s\n\t%s\n", hit.ID, hit.Time.Format(timeLayout), hit.Path, hit.Snippet)
+	}
+	return nil
+}
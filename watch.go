@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"yangsi/db"
+	"yangsi/img"
+	"yangsi/log"
+	"yangsi/retry"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// candidate is a file seen in root that isn't handed over yet, waiting for
+// its size and modification time to settle.
+type candidate struct {
+	dir, name string
+	size      int64
+	modTime   time.Time
+	// when it was last seen changing
+	since time.Time
+}
+
+type watcher struct {
+	*fsnotify.Watcher
+	settle time.Duration
+	// the dirs watched, by their cleaned path as events name them, to the
+	// path walk would give them, which jobs know the files by
+	dirs       map[string]string
+	candidates map[string]*candidate
+	// files handed over and not handled yet, by img.Path, which the workers
+	// clear
+	mu   sync.Mutex
+	busy map[string]bool
+}
+
+// watch finishes what an interrupted run left pending, then watches root
+// and its subdirectories and processes every image put there, once it stayed
+// the same for -settle. What is already there is processed first. Root is
+// walked again every -rescan for what an event was missed for.
+func watch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	settle := fs.Duration("settle", 2*time.Second, "how long a file must stay the same before it is processed")
+	rescan := fs.Duration("rescan", 10*time.Minute, "how often root is walked again, 0 for never")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *settle <= 0 {
+		return log.NewError("invalid settle: %s", *settle)
+	}
+	err = recoverPending()
+	if err != nil {
+		return err
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return log.NewError("watch failed: %s", err.Error())
+	}
+	defer fw.Close()
+	w := &watcher{
+		Watcher:    fw,
+		settle:     *settle,
+		dirs:       make(map[string]string),
+		candidates: make(map[string]*candidate),
+		busy:       make(map[string]bool),
+	}
+	err = w.add(root)
+	if err != nil {
+		return err
+	}
+	log.InfoLog("watching %s, %d files found", root, len(w.candidates))
+
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.InfoLog("interrupted, finishing the files being handled")
+		stop()
+	}()
+
+	var fileCh = make(chan *img.Image, 5)
+	wait.Add(1)
+	go func() {
+		pool(fileCh, w.handle)
+		wait.Done()
+	}()
+	w.loop(fileCh, *rescan)
+	close(fileCh)
+	wait.Wait()
+	log.InfoLog("处理成功：%d 张, 处理失败：%d 张", okNum, failedNum)
+	return nil
+}
+
+// add watches dir and the dirs below it and takes the files in them as
+// candidates, which may have been put there before dir was watched.
+func (w *watcher) add(dir string) error {
+	err := w.Add(dir)
+	if err != nil {
+		return log.NewError("watch failed: %s, %s", dir, err.Error())
+	}
+	w.dirs[filepath.Clean(dir)] = dir
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return log.NewError("read dir failed: %s, %s", dir, err.Error())
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			err = w.add(fmt.Sprintf("%s/%s", dir, f.Name()))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		w.touch(dir, f.Name())
+	}
+	return nil
+}
+
+// touch takes a file as a candidate, or one again if it changed.
+func (w *watcher) touch(dir, name string) {
+	path := fmt.Sprintf("%s/%s", dir, name)
+	c := w.candidates[path]
+	if c == nil {
+		c = &candidate{dir: dir, name: name}
+		w.candidates[path] = c
+	}
+	// stat again on the next tick
+	c.size = -1
+	c.since = time.Now()
+}
+
+// event takes what changed in a watched dir.
+func (w *watcher) event(e fsnotify.Event) {
+	dir, ok := w.dirs[filepath.Dir(e.Name)]
+	if !ok {
+		return
+	}
+	name := filepath.Base(e.Name)
+	path := fmt.Sprintf("%s/%s", dir, name)
+	switch {
+	case e.Op&(fsnotify.Create|fsnotify.Write) != 0:
+		info, err := os.Stat(e.Name)
+		if err != nil {
+			return
+		}
+		if !info.IsDir() {
+			w.touch(dir, name)
+			return
+		}
+		if _, ok := w.dirs[filepath.Clean(e.Name)]; !ok {
+			err = w.add(path)
+			if err != nil {
+				log.WriteError(err, "watch %s failed", path)
+			}
+		}
+	case e.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		delete(w.candidates, path)
+		delete(w.dirs, filepath.Clean(e.Name))
+	}
+}
+
+// waiting tells whether the job of image says it isn't to be handled now:
+// stored, kept, failed for good or not due yet. A rescan finds those again
+// every time; they are left to the next rescan.
+func waiting(image *img.Image) bool {
+	j, err := db.GetJob(image.Path())
+	if err != nil || j == nil || j.Size != image.Size || !j.ModTime.Equal(image.ModTime) {
+		return false
+	}
+	due, _ := retry.Due(j, time.Now())
+	return !due
+}
+
+// ready hands over the candidates that stayed the same for settle and are
+// not being handled still, as many as the workers take without waiting, so
+// that events are taken meanwhile; the others are tried again next tick.
+func (w *watcher) ready(fileCh chan *img.Image) bool {
+	now := time.Now()
+	for path, c := range w.candidates {
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(w.candidates, path)
+			continue
+		}
+		if info.Size() != c.size || !info.ModTime().Equal(c.modTime) {
+			c.size, c.modTime, c.since = info.Size(), info.ModTime(), now
+			continue
+		}
+		if now.Sub(c.since) < w.settle {
+			continue
+		}
+		image, err := img.NewImage(c.dir, c.name)
+		if err != nil {
+			log.WarnLog("invalid image file: %s", err)
+			delete(w.candidates, path)
+			continue
+		}
+		if waiting(image) {
+			delete(w.candidates, path)
+			continue
+		}
+		w.mu.Lock()
+		busy := w.busy[image.Path()]
+		if !busy {
+			w.busy[image.Path()] = true
+		}
+		w.mu.Unlock()
+		if busy {
+			continue
+		}
+		select {
+		case fileCh <- image:
+			delete(w.candidates, path)
+		case <-closeCh:
+			return false
+		default:
+			w.done(image.Path())
+			return true
+		}
+	}
+	return true
+}
+
+func (w *watcher) done(path string) {
+	w.mu.Lock()
+	delete(w.busy, path)
+	w.mu.Unlock()
+}
+
+func (w *watcher) handle(image *img.Image) {
+	handleImage(image)
+	w.done(image.Path())
+}
+
+// loop takes the events and hands over what is ready until stop.
+func (w *watcher) loop(fileCh chan *img.Image, rescan time.Duration) {
+	tick := time.NewTicker(w.settle / 2)
+	defer tick.Stop()
+	var rescanCh <-chan time.Time
+	if rescan > 0 {
+		t := time.NewTicker(rescan)
+		defer t.Stop()
+		rescanCh = t.C
+	}
+	for {
+		select {
+		case <-closeCh:
+			return
+		case e, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			w.event(e)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			// the kernel queue overflowed, say; the next rescan finds it
+			log.WarnLog("watch error: %s", err.Error())
+		case <-rescanCh:
+			err := w.add(root)
+			if err != nil {
+				log.WriteError(err, "rescan failed")
+			}
+		case <-tick.C:
+			if !w.ready(fileCh) {
+				return
+			}
+		}
+	}
+}